@@ -4,6 +4,7 @@ import (
 	"github.com/lusory/kitsh/handler"
 	"github.com/urfave/cli/v2"
 	"os"
+	"time"
 )
 
 // main is the application entrypoint.
@@ -13,37 +14,131 @@ func main() {
 		Usage:                "A CLI for kitsune's gRPC API",
 		EnableBashCompletion: true,
 		ExitErrHandler: func(cCtx *cli.Context, err error) {
-			if cCtx.Context.Value(handler.ConsoleCtxKey) != nil {
+			if err == nil || cCtx.Context.Value(handler.ConsoleCtxKey) != nil {
 				return // don't exit on interactive console errors
 			}
 
-			cli.HandleExitCoder(err)
+			os.Exit(handler.HandleError(cCtx, err))
 		},
 		Before: func(cCtx *cli.Context) error {
-			if cCtx.Bool("no-pretty") {
+			if cCtx.Bool("no-pretty") || !handler.IsPrettyOutput(cCtx) {
 				handler.SuccessColor.DisableColor()
+				handler.WarningColor.DisableColor()
 				handler.ErrorColor.DisableColor()
 			}
 			return nil
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "target",
-				Aliases:  []string{"t", "host"},
-				Usage:    "the kitsune target to connect to",
-				Required: true,
-				EnvVars:  []string{"KITSUNE_TARGET"},
+				Name:    "target",
+				Aliases: []string{"t", "host"},
+				Usage:   "the kitsune target to connect to (host:port, unix:///path or ssh://[user@]bastion[:port]/host:port)",
+				EnvVars: []string{"KITSUNE_TARGET"},
+			},
+			&cli.StringFlag{
+				Name:    "context",
+				Usage:   "the context to use, overrides the current context of the config file",
+				EnvVars: []string{"KITSH_CONTEXT"},
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "the path to the config file (default: $XDG_CONFIG_HOME/kitsh/config)",
+				EnvVars: []string{"KITSH_CONFIG"},
 			},
 			&cli.BoolFlag{
 				Name:  "ssl",
 				Usage: "enables SSL (TLS) for gRPC connections",
 				Value: false,
 			},
+			&cli.StringFlag{
+				Name:  "ca-file",
+				Usage: "the PEM-encoded CA certificates for verifying the server, implies --ssl (default: system pool)",
+			},
+			&cli.StringFlag{
+				Name:  "cert",
+				Usage: "the PEM-encoded client certificate for mutual TLS, implies --ssl",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Usage: "the PEM-encoded private key of the client certificate, implies --ssl",
+			},
+			&cli.StringFlag{
+				Name:  "server-name",
+				Usage: "overrides the server name used for SNI and certificate verification, implies --ssl",
+			},
+			&cli.BoolFlag{
+				Name:  "insecure-skip-verify",
+				Usage: "disables verification of the server certificate (insecure), implies --ssl",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:    "token",
+				Usage:   "the bearer token attached to every gRPC call",
+				EnvVars: []string{"KITSUNE_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:  "token-file",
+				Usage: "the path to a file containing the bearer token, re-read when the token is rejected",
+			},
+			&cli.StringFlag{
+				Name:  "credential-helper",
+				Usage: "a command printing the bearer token when invoked with the 'get' argument, re-run when the token is rejected",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-insecure-token",
+				Usage: "allows sending the bearer token over plaintext connections, e.g. to an authenticating proxy (insecure)",
+				Value: false,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "the deadline of every gRPC call attempt, overrides the timeout of the context, 0 disables it",
+				Value: 30 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "the number of times idempotent gRPC calls failing with transient errors are retried",
+				Value: 3,
+			},
+			&cli.DurationFlag{
+				Name:  "retry-backoff",
+				Usage: "the delay before the first retry, doubled for every subsequent retry",
+				Value: 250 * time.Millisecond,
+			},
+			&cli.DurationFlag{
+				Name:  "keepalive-time",
+				Usage: "the interval of keepalive pings on idle connections, 0 disables them (minimum: 10s)",
+			},
+			&cli.DurationFlag{
+				Name:  "keepalive-timeout",
+				Usage: "the time to wait for a keepalive ping acknowledgement before closing the connection",
+				Value: 20 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "prints the requests of calls modifying state as JSON instead of sending them, lookups are still sent",
+			},
+			&cli.StringFlag{
+				Name:    "name-key",
+				Usage:   "the metadata key holding the names of virtual machines and images, empty disables names",
+				Value:   "name",
+				EnvVars: []string{"KITSH_NAME_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "production-selector",
+				Usage:   "the metadata selector of production resources, destructive commands on them are confirmed by typing their name",
+				Value:   "env in (prod,production)",
+				EnvVars: []string{"KITSH_PRODUCTION_SELECTOR"},
+			},
 			&cli.BoolFlag{
 				Name:  "no-pretty",
 				Usage: "disables pretty-printing of output (useful for scripting)",
 				Value: false,
 			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "the output format (table, wide, json, yaml, csv, template=<Go template>)",
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -59,16 +154,228 @@ func main() {
 				},
 				Action: handler.Console,
 			},
+			{
+				Name:  "apply",
+				Usage: "converges kitsune to the virtual machines and images described in manifest files",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "filename",
+						Aliases:  []string{"f"},
+						Usage:    "a YAML or JSON manifest file, a directory of them or - for stdin",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "owner",
+						Usage:   "the owner recorded in the kitsh.managed-by metadata key, only resources of the owner are changed",
+						Value:   "kitsh",
+						EnvVars: []string{"KITSH_OWNER"},
+					},
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "deletes virtual machines and images of the owner missing from the manifests",
+						Value: false,
+					},
+					&cli.DurationFlag{
+						Name:  "poll-interval",
+						Usage: "the interval of polling the status while waiting for running virtual machines to stop",
+						Value: time.Second,
+					},
+					&cli.DurationFlag{
+						Name:  "wait-timeout",
+						Usage: "the time to wait for running virtual machines to stop before detaching their images",
+						Value: 5 * time.Minute,
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "skips the confirmation prompt of pruning, required if stdin is not a terminal",
+					},
+				},
+				Action: handler.Apply,
+			},
+			{
+				Name:    "plan",
+				Aliases: []string{"diff"},
+				Usage:   "previews the changes apply would make, exits with 8 if kitsune differs from the manifests",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "filename",
+						Aliases:  []string{"f"},
+						Usage:    "a YAML or JSON manifest file, a directory of them or - for stdin",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "owner",
+						Usage:   "the owner recorded in the kitsh.managed-by metadata key, only resources of the owner are changed",
+						Value:   "kitsh",
+						EnvVars: []string{"KITSH_OWNER"},
+					},
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "plans deleting virtual machines and images of the owner missing from the manifests",
+						Value: false,
+					},
+				},
+				Action: handler.Plan,
+			},
+			{
+				Name:  "export",
+				Usage: "exports all virtual machines and images as manifests for apply",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "the directory to write one manifest file per virtual machine and unattached image to, instead of stdout",
+					},
+				},
+				Action: handler.Export,
+			},
+			{
+				Name:      "schema",
+				Usage:     "prints the JSON Schemas of machine-readable output kinds",
+				ArgsUsage: "[kind...]",
+				Action:    handler.Schema,
+			},
+			{
+				Name:    "context",
+				Aliases: []string{"ctx"},
+				Usage:   "manages named contexts in the config file",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "lists all contexts",
+						Action: handler.ListContexts,
+					},
+					{
+						Name:      "use",
+						Usage:     "sets the current context",
+						ArgsUsage: "<name>",
+						Action:    handler.UseContext,
+					},
+					{
+						Name:  "add",
+						Usage: "adds a context",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "the context name",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "target",
+								Aliases:  []string{"t", "host"},
+								Usage:    "the kitsune target to connect to",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "tls",
+								Usage: "enables TLS for gRPC connections",
+								Value: false,
+							},
+							&cli.StringFlag{
+								Name:  "ca-file",
+								Usage: "the PEM-encoded CA certificates for verifying the server, implies --tls",
+							},
+							&cli.StringFlag{
+								Name:  "cert",
+								Usage: "the PEM-encoded client certificate for mutual TLS, implies --tls",
+							},
+							&cli.StringFlag{
+								Name:  "key",
+								Usage: "the PEM-encoded private key of the client certificate, implies --tls",
+							},
+							&cli.StringFlag{
+								Name:  "server-name",
+								Usage: "overrides the server name used for SNI and certificate verification, implies --tls",
+							},
+							&cli.BoolFlag{
+								Name:  "insecure-skip-verify",
+								Usage: "disables verification of the server certificate (insecure), implies --tls",
+								Value: false,
+							},
+							&cli.StringFlag{
+								Name:  "token",
+								Usage: "the bearer token attached to every gRPC call",
+							},
+							&cli.StringFlag{
+								Name:  "token-file",
+								Usage: "the path to a file containing the bearer token, re-read when the token is rejected",
+							},
+							&cli.StringFlag{
+								Name:  "credential-helper",
+								Usage: "a command printing the bearer token when invoked with the 'get' argument, re-run when the token is rejected",
+							},
+							&cli.BoolFlag{
+								Name:  "allow-insecure-token",
+								Usage: "allows sending the bearer token over plaintext connections, e.g. to an authenticating proxy (insecure)",
+								Value: false,
+							},
+							&cli.StringFlag{
+								Name:  "default-output",
+								Usage: "the default output format of the context",
+							},
+							&cli.StringFlag{
+								Name:  "timeout",
+								Usage: "the timeout of gRPC calls, e.g. '30s'",
+							},
+							&cli.BoolFlag{
+								Name:  "use",
+								Usage: "sets the added context as the current context",
+								Value: false,
+							},
+						},
+						Action: handler.AddContext,
+					},
+					{
+						Name:      "remove",
+						Aliases:   []string{"rm"},
+						Usage:     "removes a context",
+						ArgsUsage: "<name>",
+						Action:    handler.RemoveContext,
+					},
+					{
+						Name:      "show",
+						Usage:     "shows a context, the current one by default",
+						ArgsUsage: "[name]",
+						Action:    handler.ShowContext,
+					},
+				},
+			},
 			{
 				Name:    "image",
 				Aliases: []string{"img", "images", "i"},
 				Usage:   "image registry specific actions",
 				Subcommands: []*cli.Command{
 					{
-						Name:   "list",
-						Usage:  "lists all images",
+						Name:  "list",
+						Usage: "lists all images",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the images, e.g. 'env=prod,team in (infra,ops),!legacy'",
+							},
+						},
 						Action: handler.ListImages,
 					},
+					{
+						Name:  "describe",
+						Usage: "shows the details and metadata of an image and the virtual machines it is attached to",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "the image UUID, a unique UUID prefix or name",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:  "concurrency",
+								Usage: "the maximum number of virtual machines queried concurrently for attached images",
+								Value: 8,
+							},
+						},
+						Action: handler.DescribeImage,
+					},
 					{
 						Name:  "create",
 						Usage: "creates an image",
@@ -88,9 +395,17 @@ func main() {
 							&cli.StringFlag{
 								Name:    "data",
 								Aliases: []string{"d"},
-								Usage:   "the image metadata in JSON (a string-string map)",
+								Usage:   "the image metadata in JSON (a string-string map), @file reads it from a file and - from stdin",
 								Value:   "{}",
 							},
+							&cli.StringSliceFlag{
+								Name:  "meta",
+								Usage: "sets a metadata key, in the key=value format, key=@file reads the value from a file, values must not contain commas",
+							},
+							&cli.StringSliceFlag{
+								Name:  "meta-file",
+								Usage: "reads metadata from a YAML or .env file, applied after --data",
+							},
 						},
 						Action: handler.CreateImage,
 					},
@@ -99,27 +414,85 @@ func main() {
 						Usage: "deletes an image",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
-								Name:     "id",
-								Aliases:  []string{"i"},
-								Usage:    "the image UUID (must conform to a v4 UUID)",
-								Required: true,
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the image UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the images to delete, instead of --id",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "detach the images from all virtual machines using them instead of refusing to delete them",
+							},
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
 							},
 						},
 						Action: handler.DeleteImage,
 					},
+					{
+						Name:  "protect",
+						Usage: "protects an image from being deleted, detached or cleared of metadata",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the image UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the images to protect, instead of --id",
+							},
+						},
+						Action: handler.ProtectImage,
+					},
+					{
+						Name:  "unprotect",
+						Usage: "removes the protection of an image",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the image UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the images to unprotect, instead of --id",
+							},
+						},
+						Action: handler.UnprotectImage,
+					},
 					{
 						Name:  "metadata",
 						Usage: "gets image metadata",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
-								Name:     "id",
-								Aliases:  []string{"i"},
-								Usage:    "the image UUID (must conform to a v4 UUID)",
-								Required: true,
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the image UUID, a unique UUID prefix or name",
 							},
 						},
 						Action: handler.GetImageMetadata,
 						Subcommands: []*cli.Command{
+							{
+								Name:  "get",
+								Usage: "gets image metadata, or the value of a single key",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:    "key",
+										Aliases: []string{"k"},
+										Usage:   "the key to print the value of",
+									},
+								},
+								Action: handler.GetImageMetadata,
+							},
 							{
 								Name:  "set",
 								Usage: "sets image metadata",
@@ -127,11 +500,56 @@ func main() {
 									&cli.StringFlag{
 										Name:    "data",
 										Aliases: []string{"d"},
-										Usage:   "the image metadata in JSON (a string-string map)",
+										Usage:   "the image metadata in JSON (a string-string map), @file reads it from a file and - from stdin",
+									},
+									&cli.StringSliceFlag{
+										Name:  "meta",
+										Usage: "sets a metadata key, in the key=value format, key=@file reads the value from a file, values must not contain commas",
+									},
+									&cli.StringSliceFlag{
+										Name:  "meta-file",
+										Usage: "reads metadata from a YAML or .env file, applied after --data",
+									},
+									&cli.StringFlag{
+										Name:    "selector",
+										Aliases: []string{"l"},
+										Usage:   "the metadata selector of the images to set the metadata of, instead of --id",
 									},
 								},
 								Action: handler.SetImageMetadata,
 							},
+							{
+								Name:  "patch",
+								Usage: "updates image metadata in place, keeping other keys",
+								Flags: []cli.Flag{
+									&cli.StringSliceFlag{
+										Name:    "set",
+										Aliases: []string{"s"},
+										Usage:   "sets a key, in the key=value format, values must not contain commas",
+									},
+									&cli.StringSliceFlag{
+										Name:    "unset",
+										Aliases: []string{"u"},
+										Usage:   "unsets a key",
+									},
+									&cli.StringFlag{
+										Name:    "data",
+										Aliases: []string{"d"},
+										Usage:   "a JSON merge patch of the metadata (null unsets a key), applied before --set and --unset, @file reads it from a file and - from stdin",
+									},
+									&cli.StringFlag{
+										Name:    "selector",
+										Aliases: []string{"l"},
+										Usage:   "the metadata selector of the images to patch the metadata of, instead of --id",
+									},
+								},
+								Action: handler.PatchImageMetadata,
+							},
+							{
+								Name:   "edit",
+								Usage:  "edits image metadata in $KITSH_EDITOR, $VISUAL or $EDITOR",
+								Action: handler.EditImageMetadata,
+							},
 							{
 								Name:  "clear",
 								Usage: "clears image metadata, equivalent to setting '{}' as metadata",
@@ -142,6 +560,11 @@ func main() {
 										Value:  "{}",
 										Hidden: true,
 									},
+									&cli.BoolFlag{
+										Name:    "yes",
+										Aliases: []string{"y"},
+										Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+									},
 								},
 								Action: handler.ClearImageMetadata,
 							},
@@ -154,8 +577,15 @@ func main() {
 				Usage: "virtual machine registry specific actions",
 				Subcommands: []*cli.Command{
 					{
-						Name:   "list",
-						Usage:  "lists all virtual machines",
+						Name:  "list",
+						Usage: "lists all virtual machines",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines, e.g. 'env=prod,team in (infra,ops),!legacy'",
+							},
+						},
 						Action: handler.ListVirtualMachines,
 					},
 					{
@@ -177,25 +607,129 @@ func main() {
 							&cli.StringFlag{
 								Name:    "data",
 								Aliases: []string{"d"},
-								Usage:   "the virtual machine metadata in JSON (a string-string map)",
+								Usage:   "the virtual machine metadata in JSON (a string-string map), @file reads it from a file and - from stdin",
 								Value:   "{}",
 							},
+							&cli.StringSliceFlag{
+								Name:  "meta",
+								Usage: "sets a metadata key, in the key=value format, key=@file reads the value from a file, values must not contain commas",
+							},
+							&cli.StringSliceFlag{
+								Name:  "meta-file",
+								Usage: "reads metadata from a YAML or .env file, applied after --data",
+							},
+							&cli.StringSliceFlag{
+								Name:  "disk",
+								Usage: "creates an image and attaches it, in the format:size[:key=value...] format with a K, M, G or T size suffix, e.g. qcow2:10G:name=root",
+							},
+							&cli.StringSliceFlag{
+								Name:  "attach",
+								Usage: "attaches an existing image, by UUID, unique UUID prefix or name, after the disks",
+							},
 						},
 						Action: handler.CreateVirtualMachine,
 					},
 					{
-						Name:  "delete",
-						Usage: "deletes a virtual machine",
+						Name:  "clone",
+						Usage: "creates a virtual machine with the shape of another one, with fresh images of the same format and size",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
+							&cli.StringFlag{
+								Name:    "name",
+								Aliases: []string{"n"},
+								Usage:   "the name of the clone, stored in the --name-key metadata key",
+							},
+							&cli.StringFlag{
+								Name:    "data",
+								Aliases: []string{"d"},
+								Usage:   "metadata overrides in JSON (a string-string map), @file reads them from a file and - from stdin",
+							},
+							&cli.StringSliceFlag{
+								Name:  "meta",
+								Usage: "overrides a metadata key, in the key=value format, key=@file reads the value from a file, values must not contain commas",
+							},
+							&cli.StringSliceFlag{
+								Name:  "meta-file",
+								Usage: "reads metadata overrides from a YAML or .env file, applied after --data",
+							},
+						},
+						Action: handler.CloneVirtualMachine,
+					},
+					{
+						Name:  "delete",
+						Usage: "deletes a virtual machine",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to delete, instead of --id",
+							},
+							&cli.BoolFlag{
+								Name:  "cascade",
+								Usage: "power off the virtual machines, detach their images and delete those not used by other virtual machines",
+							},
+							&cli.DurationFlag{
+								Name:  "poll-interval",
+								Usage: "the interval of polling the status while waiting for running virtual machines to stop",
+								Value: time.Second,
+							},
+							&cli.DurationFlag{
+								Name:  "wait-timeout",
+								Usage: "the time to wait for running virtual machines to stop before detaching their images",
+								Value: 5 * time.Minute,
+							},
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+							},
 						},
 						Action: handler.DeleteVirtualMachine,
 					},
+					{
+						Name:  "protect",
+						Usage: "protects a virtual machine from being deleted, detached, cleared of metadata, powered off or reset",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to protect, instead of --id",
+							},
+						},
+						Action: handler.ProtectVirtualMachine,
+					},
+					{
+						Name:  "unprotect",
+						Usage: "removes the protection of a virtual machine",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to unprotect, instead of --id",
+							},
+						},
+						Action: handler.UnprotectVirtualMachine,
+					},
 					{
 						Name:  "status",
 						Usage: "queries a virtual machine for status",
@@ -203,12 +737,25 @@ func main() {
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 						},
 						Action: handler.GetStatus,
 					},
+					{
+						Name:  "describe",
+						Usage: "shows the details, status, attached images, metadata and VNC servers of a virtual machine",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Aliases:  []string{"i"},
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
+								Required: true,
+							},
+						},
+						Action: handler.DescribeVirtualMachine,
+					},
 					{
 						Name:  "images",
 						Usage: "lists images attached to a virtual machine",
@@ -216,7 +763,7 @@ func main() {
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 						},
@@ -229,12 +776,12 @@ func main() {
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 							&cli.StringFlag{
 								Name:     "image",
-								Usage:    "the image UUID (must conform to a v4 UUID)",
+								Usage:    "the image UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 						},
@@ -247,12 +794,12 @@ func main() {
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 							&cli.StringFlag{
 								Name:     "image",
-								Usage:    "the image UUID (must conform to a v4 UUID)",
+								Usage:    "the image UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 						},
@@ -265,7 +812,7 @@ func main() {
 							&cli.StringFlag{
 								Name:     "id",
 								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
+								Usage:    "the virtual machine UUID, a unique UUID prefix or name",
 								Required: true,
 							},
 							&cli.StringFlag{
@@ -281,33 +828,141 @@ func main() {
 						Usage: "sends a power command to the virtual machine",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
-								Name:     "id",
-								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
-								Required: true,
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to send the power command to, instead of --id",
 							},
 							&cli.StringFlag{
 								Name:     "action",
 								Aliases:  []string{"a"},
-								Usage:    "the power action (poweron, poweroff, reset)",
+								Usage:    "the power action (poweron, poweroff or powerdown, powerdown_acpi, reset)",
 								Required: true,
 							},
+							&cli.BoolFlag{
+								Name:  "wait",
+								Usage: "waits until the virtual machines are running (poweron, reset) or stopped (the other actions)",
+							},
+							&cli.DurationFlag{
+								Name:  "poll-interval",
+								Usage: "the interval of polling the status while waiting",
+								Value: time.Second,
+							},
+							&cli.DurationFlag{
+								Name:  "wait-timeout",
+								Usage: "the time to wait for the virtual machines to reach the expected status",
+								Value: 5 * time.Minute,
+							},
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+							},
 						},
 						Action: handler.Power,
 					},
+					{
+						Name:  "stop",
+						Usage: "shuts a virtual machine down via ACPI, powering it off if it doesn't stop within the grace period",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to stop one after another, instead of --id",
+							},
+							&cli.DurationFlag{
+								Name:  "grace",
+								Usage: "the time to wait for an ACPI shutdown before powering off",
+								Value: time.Minute,
+							},
+							&cli.DurationFlag{
+								Name:  "poll-interval",
+								Usage: "the interval of polling the status while waiting",
+								Value: time.Second,
+							},
+							&cli.DurationFlag{
+								Name:  "wait-timeout",
+								Usage: "the time to wait for the virtual machines to reach the expected status",
+								Value: 5 * time.Minute,
+							},
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+							},
+						},
+						Action: handler.StopVirtualMachine,
+					},
+					{
+						Name:  "restart",
+						Usage: "stops a virtual machine like stop and powers it on again, waiting until it is running",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
+							},
+							&cli.StringFlag{
+								Name:    "selector",
+								Aliases: []string{"l"},
+								Usage:   "the metadata selector of the virtual machines to restart one after another, instead of --id",
+							},
+							&cli.DurationFlag{
+								Name:  "grace",
+								Usage: "the time to wait for an ACPI shutdown before powering off",
+								Value: time.Minute,
+							},
+							&cli.DurationFlag{
+								Name:  "poll-interval",
+								Usage: "the interval of polling the status while waiting",
+								Value: time.Second,
+							},
+							&cli.DurationFlag{
+								Name:  "wait-timeout",
+								Usage: "the time to wait for the virtual machines to reach the expected status",
+								Value: 5 * time.Minute,
+							},
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+							},
+						},
+						Action: handler.RestartVirtualMachine,
+					},
 					{
 						Name:  "metadata",
 						Usage: "gets virtual machine metadata",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
-								Name:     "id",
-								Aliases:  []string{"i"},
-								Usage:    "the virtual machine UUID (must conform to a v4 UUID)",
-								Required: true,
+								Name:    "id",
+								Aliases: []string{"i"},
+								Usage:   "the virtual machine UUID, a unique UUID prefix or name",
 							},
 						},
 						Action: handler.GetVmMetadata,
 						Subcommands: []*cli.Command{
+							{
+								Name:  "get",
+								Usage: "gets virtual machine metadata, or the value of a single key",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:    "key",
+										Aliases: []string{"k"},
+										Usage:   "the key to print the value of",
+									},
+								},
+								Action: handler.GetVmMetadata,
+							},
 							{
 								Name:  "set",
 								Usage: "sets virtual machine metadata",
@@ -315,11 +970,56 @@ func main() {
 									&cli.StringFlag{
 										Name:    "data",
 										Aliases: []string{"d"},
-										Usage:   "the virtual machine metadata in JSON (a string-string map)",
+										Usage:   "the virtual machine metadata in JSON (a string-string map), @file reads it from a file and - from stdin",
+									},
+									&cli.StringSliceFlag{
+										Name:  "meta",
+										Usage: "sets a metadata key, in the key=value format, key=@file reads the value from a file, values must not contain commas",
+									},
+									&cli.StringSliceFlag{
+										Name:  "meta-file",
+										Usage: "reads metadata from a YAML or .env file, applied after --data",
+									},
+									&cli.StringFlag{
+										Name:    "selector",
+										Aliases: []string{"l"},
+										Usage:   "the metadata selector of the virtual machines to set the metadata of, instead of --id",
 									},
 								},
 								Action: handler.SetVmMetadata,
 							},
+							{
+								Name:  "patch",
+								Usage: "updates virtual machine metadata in place, keeping other keys",
+								Flags: []cli.Flag{
+									&cli.StringSliceFlag{
+										Name:    "set",
+										Aliases: []string{"s"},
+										Usage:   "sets a key, in the key=value format, values must not contain commas",
+									},
+									&cli.StringSliceFlag{
+										Name:    "unset",
+										Aliases: []string{"u"},
+										Usage:   "unsets a key",
+									},
+									&cli.StringFlag{
+										Name:    "data",
+										Aliases: []string{"d"},
+										Usage:   "a JSON merge patch of the metadata (null unsets a key), applied before --set and --unset, @file reads it from a file and - from stdin",
+									},
+									&cli.StringFlag{
+										Name:    "selector",
+										Aliases: []string{"l"},
+										Usage:   "the metadata selector of the virtual machines to patch the metadata of, instead of --id",
+									},
+								},
+								Action: handler.PatchVmMetadata,
+							},
+							{
+								Name:   "edit",
+								Usage:  "edits virtual machine metadata in $KITSH_EDITOR, $VISUAL or $EDITOR",
+								Action: handler.EditVmMetadata,
+							},
 							{
 								Name:  "clear",
 								Usage: "clears virtual machine metadata, equivalent to setting '{}' as metadata",
@@ -330,6 +1030,11 @@ func main() {
 										Value:  "{}",
 										Hidden: true,
 									},
+									&cli.BoolFlag{
+										Name:    "yes",
+										Aliases: []string{"y"},
+										Usage:   "skips the confirmation prompt, required if stdin is not a terminal",
+									},
 								},
 								Action: handler.ClearVmMetadata,
 							},
@@ -342,6 +1047,6 @@ func main() {
 
 	if err := app.Run(os.Args); err != nil {
 		handler.PrintError("%s\n", err)
-		os.Exit(1)
+		os.Exit(handler.ExitCode(err))
 	}
 }
@@ -0,0 +1,634 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"sort"
+	"strings"
+)
+
+// ManagedByKey is the metadata key marking virtual machines and images managed by "kitsh apply",
+// it holds the owner supplied by the "owner" flag. Managed resources are matched by their name.
+const ManagedByKey = "kitsh.managed-by"
+
+// MissingNameKey is an error about "kitsh apply" being invoked with names disabled.
+var MissingNameKey = errors.New("kitsh apply matches resources by name, --name-key must not be empty")
+
+// MissingOwner is an error about "kitsh apply" being invoked with an empty owner.
+var MissingOwner = errors.New("the owner must not be empty")
+
+// Op is an operation of an Action.
+type Op string
+
+const (
+	// OpCreate creates a virtual machine or an image.
+	OpCreate Op = "create"
+	// OpUpdate replaces the metadata of a virtual machine or an image.
+	OpUpdate Op = "update"
+	// OpAttach attaches an image to a virtual machine.
+	OpAttach Op = "attach"
+	// OpDetach detaches an image from a virtual machine.
+	OpDetach Op = "detach"
+	// OpDelete deletes a virtual machine or an image.
+	OpDelete Op = "delete"
+)
+
+// Action is a single change made by "kitsh apply" to converge kitsune to the manifests.
+type Action struct {
+	// Op is the operation of the action.
+	Op Op `json:"op"`
+	// Resource is the kind of the changed resource, either VirtualMachine or Image.
+	Resource Kind `json:"resource"`
+	// Name is the name of the changed resource.
+	Name string `json:"name"`
+	// Id is the ID of the changed resource, omitted if it wasn't created yet.
+	Id *v1.UUID `json:"id,omitempty"`
+	// Image is the name or UUID of the attached or detached image.
+	Image string `json:"image,omitempty"`
+	// Before is the metadata before an update or a deletion.
+	Before map[string]string `json:"before,omitempty"`
+	// After is the metadata after a creation or an update.
+	After map[string]string `json:"after,omitempty"`
+
+	image *ImageManifest
+	vm    *VirtualMachineManifest
+	// detach are the references of the images detached from a virtual machine before deleting it.
+	detach []string
+}
+
+// managedImage is an image managed by "kitsh apply".
+type managedImage struct {
+	image *v1.Image
+	data  map[string]string
+}
+
+// managedVm is a virtual machine managed by "kitsh apply", along with the references of its attached images.
+type managedVm struct {
+	vm     *v1.VirtualMachine
+	data   map[string]string
+	images []string
+}
+
+// applyState is the state of kitsune relevant to "kitsh apply".
+type applyState struct {
+	owner   string
+	nameKey string
+	images  map[string]*managedImage
+	vms     map[string]*managedVm
+	// unmanaged are the names of resources not managed by the owner, by their kind.
+	unmanaged map[Kind]map[string]bool
+	// protectedImages are the UUIDs of protected images by their reference, see imageRef.
+	protectedImages map[string]*v1.UUID
+	// foreign are the attachments of virtual machines not managed by the owner, which apply never detaches.
+	foreign *attachments
+}
+
+// Apply is a handler for the "apply" command.
+func Apply(cCtx *cli.Context) error {
+	w, err := newPowerWait(cCtx)
+	if err != nil {
+		return err
+	}
+
+	client, state, actions, err := planManifests(cCtx)
+	if err != nil {
+		return err
+	}
+
+	var vmIds, imageIds []*v1.UUID
+	for _, action := range actions {
+		if action.Op == OpDelete && action.Resource == KindVirtualMachine {
+			vmIds = append(vmIds, action.Id)
+		} else if action.Op == OpDelete {
+			imageIds = append(imageIds, action.Id)
+		}
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: "delete", kind: KindVirtualMachine, ids: vmIds}); err != nil {
+		return err
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: "delete", kind: KindImage, ids: imageIds}); err != nil {
+		return err
+	}
+
+	applied, err := state.execute(cCtx.Context, client, w, actions)
+	if len(applied) == 0 && err == nil {
+		if format, _, _ := outputFormat(cCtx); format == OutputTable || format == OutputWide {
+			PrintSuccess("Everything is up to date.\n")
+			return nil
+		}
+	}
+
+	if renderErr := renderActions(cCtx, applied); renderErr != nil {
+		return renderErr
+	}
+	return err
+}
+
+// planManifests loads the manifests of the "filename" flag and plans the actions converging kitsune to them.
+func planManifests(cCtx *cli.Context) (*libkitsune.KitsuneClient, *applyState, []*Action, error) {
+	nameKey, owner := cCtx.String("name-key"), cCtx.String("owner")
+	if nameKey == "" {
+		return nil, nil, nil, MissingNameKey
+	}
+	if owner == "" {
+		return nil, nil, nil, MissingOwner
+	}
+
+	manifests, err := loadManifests(cCtx.StringSlice("filename"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := manifests.validate(nameKey, ManagedByKey); err != nil {
+		return nil, nil, nil, err
+	}
+
+	client, err := newClient(cCtx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	state, err := fetchApplyState(cCtx.Context, client, owner, nameKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	actions, err := state.plan(manifests, cCtx.Bool("prune"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return client, state, actions, nil
+}
+
+// fetchApplyState fetches the inventory of kitsune, recording the virtual machines and images managed by the
+// supplied owner by name.
+func fetchApplyState(ctx context.Context, client *libkitsune.KitsuneClient, owner, nameKey string) (*applyState, error) {
+	inv, err := fetchInventory(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &applyState{
+		owner:           owner,
+		nameKey:         nameKey,
+		images:          make(map[string]*managedImage),
+		vms:             make(map[string]*managedVm),
+		unmanaged:       map[Kind]map[string]bool{KindImage: {}, KindVirtualMachine: {}},
+		protectedImages: make(map[string]*v1.UUID),
+	}
+
+	imageNames := make(map[string]string)
+	for i, image := range inv.images {
+		data := inv.imageData[i]
+		name, ok := data[nameKey]
+		if data[ManagedByKey] != owner || !ok {
+			if ok {
+				state.unmanaged[KindImage][name] = true
+			}
+			continue
+		}
+		if other, ok := state.images[name]; ok {
+			return nil, fmt.Errorf(
+				"images %s and %s are both managed as %s, delete one of them",
+				other.image.GetId().GetValue(), image.GetId().GetValue(), name,
+			)
+		}
+
+		state.images[name] = &managedImage{image: image, data: data}
+		imageNames[image.GetId().GetValue()] = name
+	}
+
+	for i, image := range inv.images {
+		if isProtected(inv.imageData[i]) {
+			state.protectedImages[imageRef(image.GetId().GetValue(), imageNames)] = image.GetId()
+		}
+	}
+
+	var foreignVms []*v1.VirtualMachine
+	var foreignImages [][]*v1.UUID
+	for i, vm := range inv.vms {
+		data := inv.vmData[i]
+		name, ok := data[nameKey]
+		if data[ManagedByKey] != owner || !ok {
+			if ok {
+				state.unmanaged[KindVirtualMachine][name] = true
+			}
+			foreignVms = append(foreignVms, vm)
+			foreignImages = append(foreignImages, inv.vmImages[i])
+			continue
+		}
+		if other, ok := state.vms[name]; ok {
+			return nil, fmt.Errorf(
+				"virtual machines %s and %s are both managed as %s, delete one of them",
+				other.vm.GetId().GetValue(), vm.GetId().GetValue(), name,
+			)
+		}
+
+		managed := &managedVm{vm: vm, data: data}
+		for _, imageId := range inv.vmImages[i] {
+			managed.images = append(managed.images, imageRef(imageId.GetValue(), imageNames))
+		}
+		state.vms[name] = managed
+	}
+	state.foreign = newAttachments(foreignVms, foreignImages)
+
+	return state, nil
+}
+
+// imageRef gets the reference of the image with the supplied ID used in manifests,
+// the name of managed images and the UUID of other images.
+func imageRef(id string, imageNames map[string]string) string {
+	if name, ok := imageNames[strings.ToLower(id)]; ok {
+		return name
+	}
+	return strings.ToLower(id)
+}
+
+// desiredMetadata gets the metadata a managed resource should have, keeping the protection of an existing resource
+// unless the manifest sets it.
+func (s *applyState) desiredMetadata(name string, data, existing map[string]string) map[string]string {
+	desired := make(map[string]string, len(data)+3)
+	if protected, ok := existing[ProtectedKey]; ok {
+		desired[ProtectedKey] = protected
+	}
+	for key, value := range data {
+		desired[key] = value
+	}
+	desired[s.nameKey] = name
+	desired[ManagedByKey] = s.owner
+
+	return desired
+}
+
+// plan computes the actions converging kitsune to the supplied manifests, in the order they need to be executed.
+// Managed resources missing from the manifests are deleted if prune is true.
+func (s *applyState) plan(manifests *Manifests, prune bool) ([]*Action, error) {
+	imageNames := make(map[string]string)
+	for name, image := range s.images {
+		imageNames[image.image.GetId().GetValue()] = name
+	}
+
+	var updates, attachments, deletions []*Action
+
+	wantImages := make(map[string]bool)
+	for _, manifest := range manifests.Images {
+		wantImages[manifest.Name] = true
+
+		existing, ok := s.images[manifest.Name]
+		if !ok {
+			if s.unmanaged[KindImage][manifest.Name] {
+				return nil, &KitshError{Code: codes.FailedPrecondition, Msg: fmt.Sprintf(
+					"image %s already exists, but isn't managed by %s", manifest.Name, s.owner,
+				)}
+			}
+
+			desired := s.desiredMetadata(manifest.Name, manifest.Metadata, nil)
+			updates = append(updates, &Action{Op: OpCreate, Resource: KindImage, Name: manifest.Name, After: desired, image: manifest})
+			continue
+		}
+
+		format := existing.image.GetFormat().String()
+		if !strings.EqualFold(format, manifest.Format) || existing.image.GetSize() != manifest.Size {
+			return nil, &KitshError{Code: codes.FailedPrecondition, Msg: fmt.Sprintf(
+				"image %s is %s with %d bytes and can't be changed to %s with %d bytes, delete it to recreate it",
+				manifest.Name, format, existing.image.GetSize(), strings.ToUpper(manifest.Format), manifest.Size,
+			)}
+		}
+		if desired := s.desiredMetadata(manifest.Name, manifest.Metadata, existing.data); !equalMetadata(existing.data, desired) {
+			updates = append(updates, &Action{
+				Op: OpUpdate, Resource: KindImage, Name: manifest.Name, Id: existing.image.GetId(),
+				Before: existing.data, After: desired,
+			})
+		}
+	}
+
+	var vmUpdates []*Action
+	wantVms := make(map[string]bool)
+	vmRefs := make([][]string, len(manifests.VirtualMachines))
+	for i, manifest := range manifests.VirtualMachines {
+		wantVms[manifest.Name] = true
+
+		refs := make([]string, len(manifest.Images))
+		for i, ref := range manifest.Images {
+			if id, err := uuid.Parse(ref); err == nil {
+				ref = imageRef(id.String(), imageNames)
+			}
+			refs[i] = ref
+		}
+		vmRefs[i] = refs
+
+		existing, ok := s.vms[manifest.Name]
+		if !ok {
+			if s.unmanaged[KindVirtualMachine][manifest.Name] {
+				return nil, &KitshError{Code: codes.FailedPrecondition, Msg: fmt.Sprintf(
+					"virtual machine %s already exists, but isn't managed by %s", manifest.Name, s.owner,
+				)}
+			}
+
+			desired := s.desiredMetadata(manifest.Name, manifest.Metadata, nil)
+			vmUpdates = append(vmUpdates, &Action{Op: OpCreate, Resource: KindVirtualMachine, Name: manifest.Name, After: desired, vm: manifest})
+			for _, ref := range refs {
+				attachments = append(attachments, &Action{Op: OpAttach, Resource: KindVirtualMachine, Name: manifest.Name, Image: ref})
+			}
+			continue
+		}
+
+		arch := existing.vm.GetArch().String()
+		if !strings.EqualFold(arch, manifest.Arch) || existing.vm.GetMemorySize() != manifest.Memory {
+			return nil, &KitshError{Code: codes.FailedPrecondition, Msg: fmt.Sprintf(
+				"virtual machine %s is %s with %d MB and can't be changed to %s with %d MB, delete it to recreate it",
+				manifest.Name, arch, existing.vm.GetMemorySize(), strings.ToUpper(manifest.Arch), manifest.Memory,
+			)}
+		}
+		if desired := s.desiredMetadata(manifest.Name, manifest.Metadata, existing.data); !equalMetadata(existing.data, desired) {
+			vmUpdates = append(vmUpdates, &Action{
+				Op: OpUpdate, Resource: KindVirtualMachine, Name: manifest.Name, Id: existing.vm.GetId(),
+				Before: existing.data, After: desired,
+			})
+		}
+
+		for _, ref := range existing.images {
+			if !containsString(refs, ref) {
+				if isProtected(existing.data) {
+					return nil, &ProtectedError{Kind: KindVirtualMachine, Id: existing.vm.GetId(), Op: "detach images from"}
+				}
+				if id, ok := s.protectedImages[ref]; ok {
+					return nil, &ProtectedError{Kind: KindImage, Id: id, Op: "detach"}
+				}
+
+				attachments = append(attachments, &Action{
+					Op: OpDetach, Resource: KindVirtualMachine, Name: manifest.Name, Id: existing.vm.GetId(), Image: ref,
+				})
+			}
+		}
+		for _, ref := range refs {
+			if !containsString(existing.images, ref) {
+				attachments = append(attachments, &Action{
+					Op: OpAttach, Resource: KindVirtualMachine, Name: manifest.Name, Id: existing.vm.GetId(), Image: ref,
+				})
+			}
+		}
+	}
+
+	if prune {
+		for name, vm := range s.vms {
+			if !wantVms[name] {
+				if isProtected(vm.data) {
+					return nil, &ProtectedError{Kind: KindVirtualMachine, Id: vm.vm.GetId(), Op: "delete"}
+				}
+				for _, ref := range vm.images {
+					if id, ok := s.protectedImages[ref]; ok {
+						return nil, &ProtectedError{Kind: KindImage, Id: id, Op: "detach"}
+					}
+				}
+
+				deletions = append(deletions, &Action{
+					Op: OpDelete, Resource: KindVirtualMachine, Name: name, Id: vm.vm.GetId(), Before: vm.data,
+					detach: vm.images,
+				})
+			}
+		}
+		for name, image := range s.images {
+			if !wantImages[name] {
+				if isProtected(image.data) {
+					return nil, &ProtectedError{Kind: KindImage, Id: image.image.GetId(), Op: "delete"}
+				}
+				// managed virtual machines end up with the images of their manifests, or are deleted along the way
+				if err := refuseAttached(s.foreign, image.image.GetId(), "detach it first or keep it in the manifests"); err != nil {
+					return nil, err
+				}
+				for i, manifest := range manifests.VirtualMachines {
+					if containsString(vmRefs[i], name) {
+						return nil, &KitshError{Code: codes.FailedPrecondition, Msg: fmt.Sprintf(
+							"image %s is missing from the manifests, but virtual machine %s references it by UUID",
+							name, manifest.Name,
+						)}
+					}
+				}
+
+				deletions = append(deletions, &Action{
+					Op: OpDelete, Resource: KindImage, Name: name, Id: image.image.GetId(), Before: image.data,
+				})
+			}
+		}
+
+		// virtual machines first, they may hold images, and by name for a stable order
+		sort.Slice(deletions, func(i, j int) bool {
+			if deletions[i].Resource != deletions[j].Resource {
+				return deletions[i].Resource == KindVirtualMachine
+			}
+			return deletions[i].Name < deletions[j].Name
+		})
+	}
+
+	// detach first, so that an image moved between virtual machines is never attached twice
+	sort.SliceStable(attachments, func(i, j int) bool {
+		return attachments[i].Op == OpDetach && attachments[j].Op == OpAttach
+	})
+
+	actions := append(updates, vmUpdates...)
+	actions = append(actions, attachments...)
+	return append(actions, deletions...), nil
+}
+
+// execute executes the supplied actions in order, stopping at the first error.
+// It returns the executed actions, with the IDs of created resources filled in.
+func (s *applyState) execute(ctx context.Context, client *libkitsune.KitsuneClient, w *powerWait, actions []*Action) ([]*Action, error) {
+	imageIds := make(map[string]*v1.UUID)
+	for name, image := range s.images {
+		imageIds[name] = image.image.GetId()
+	}
+	vmIds := make(map[string]*v1.UUID)
+	for name, vm := range s.vms {
+		vmIds[name] = vm.vm.GetId()
+	}
+
+	for i, action := range actions {
+		if action.Resource == KindVirtualMachine && action.Id == nil {
+			action.Id = vmIds[action.Name]
+		}
+
+		var err error
+		switch {
+		case action.Op == OpCreate && action.Resource == KindImage:
+			format := v1.Image_Format(v1.Image_Format_value[strings.ToUpper(action.image.Format)])
+			var image *v1.Image
+			if image, err = createImage(ctx, client, format, action.image.Size, action.After); err == nil {
+				action.Id = image.GetId()
+				imageIds[action.Name] = action.Id
+			}
+		case action.Op == OpCreate && action.Resource == KindVirtualMachine:
+			arch := v1.Architecture(v1.Architecture_value[strings.ToUpper(action.vm.Arch)])
+			var vm *v1.VirtualMachine
+			if vm, err = createVirtualMachine(ctx, client, arch, action.vm.Memory, action.After); err == nil {
+				action.Id = vm.GetId()
+				vmIds[action.Name] = action.Id
+			}
+		case action.Op == OpUpdate && action.Resource == KindImage:
+			err = writeMetadata(ctx, client.ImageRegistry, action.Id, action.Before, action.After)
+		case action.Op == OpUpdate && action.Resource == KindVirtualMachine:
+			err = writeMetadata(ctx, client.VmRegistry, action.Id, action.Before, action.After)
+		case action.Op == OpAttach || action.Op == OpDetach:
+			err = attachImage(ctx, client, action.Op, action.Id, resolveImageRef(action.Image, imageIds))
+		case action.Op == OpDelete && action.Resource == KindImage:
+			err = deleteImage(ctx, client, action.Id)
+		case action.Op == OpDelete && action.Resource == KindVirtualMachine:
+			c := &cascade{vm: action.Id}
+			for _, ref := range action.detach {
+				c.detach = append(c.detach, resolveImageRef(ref, imageIds))
+			}
+			if c.alive, err = isAlive(ctx, client, action.Id); err == nil {
+				err = c.run(ctx, client, w)
+			}
+		}
+
+		if err != nil {
+			return actions[:i], fmt.Errorf("failed to %s %s %s: %w", action.Op, action.Resource, action.Name, err)
+		}
+	}
+
+	return actions, nil
+}
+
+// resolveImageRef resolves an image reference of a manifest, either the name of a managed image or a UUID.
+func resolveImageRef(ref string, imageIds map[string]*v1.UUID) *v1.UUID {
+	if id, ok := imageIds[ref]; ok {
+		return id
+	}
+	return &v1.UUID{Value: ref}
+}
+
+// createImage creates an image with the supplied metadata.
+func createImage(ctx context.Context, client *libkitsune.KitsuneClient, format v1.Image_Format, size uint64, data map[string]string) (*v1.Image, error) {
+	res, err := client.ImageRegistry.CreateImage(ctx, &v1.CreateImageRequest{
+		Format: format,
+		Size:   size,
+		Data:   &v1.MetadataMap{Data: data},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.GetError() != nil {
+		return nil, formatError(res.GetError())
+	}
+
+	return res.GetImage(), nil
+}
+
+// createVirtualMachine creates a virtual machine with the supplied metadata.
+func createVirtualMachine(ctx context.Context, client *libkitsune.KitsuneClient, arch v1.Architecture, memory uint64, data map[string]string) (*v1.VirtualMachine, error) {
+	res, err := client.VmRegistry.CreateVirtualMachine(ctx, &v1.CreateVirtualMachineRequest{
+		Arch:       arch,
+		MemorySize: memory,
+		Data:       &v1.MetadataMap{Data: data},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.GetError() != nil {
+		return nil, formatError(res.GetError())
+	}
+
+	return res.GetMachine(), nil
+}
+
+// attachImage attaches (OpAttach) or detaches (OpDetach) the supplied image to or from the supplied virtual machine.
+func attachImage(ctx context.Context, client *libkitsune.KitsuneClient, op Op, vm, image *v1.UUID) error {
+	var resErr *v1.Error
+	if op == OpAttach {
+		res, err := client.VmRegistry.AttachImage(ctx, &v1.AttachImageRequest{Machine: vm, Image: image})
+		if err != nil {
+			return err
+		}
+		resErr = res.GetError()
+	} else {
+		res, err := client.VmRegistry.DetachImage(ctx, &v1.DetachImageRequest{Machine: vm, Image: image})
+		if err != nil {
+			return err
+		}
+		resErr = res.GetError()
+	}
+
+	if resErr != nil {
+		return formatError(resErr)
+	}
+	return nil
+}
+
+// deleteImage deletes the supplied image.
+func deleteImage(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID) error {
+	res, err := client.ImageRegistry.DeleteImage(ctx, &v1.DeleteImageRequest{Id: id})
+	if err != nil {
+		return err
+	}
+	if res.GetError() != nil {
+		return formatError(res.GetError())
+	}
+
+	return nil
+}
+
+// deleteVirtualMachine deletes the supplied virtual machine.
+func deleteVirtualMachine(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID) error {
+	res, err := client.VmRegistry.DeleteVirtualMachine(ctx, &v1.DeleteVirtualMachineRequest{Id: id})
+	if err != nil {
+		return err
+	}
+	if res.GetError() != nil {
+		return formatError(res.GetError())
+	}
+
+	return nil
+}
+
+// renderActions renders the supplied actions as "Action" items.
+func renderActions(cCtx *cli.Context, actions []*Action) error {
+	out := NewOutput(KindAction, "Action", "Resource", "Name", "ID", "Details")
+	for _, action := range actions {
+		out.Add(action, action.Op, action.Resource, action.Name, action.Id.GetValue(), formatActionDetails(action))
+	}
+
+	return out.Render(cCtx)
+}
+
+// formatActionDetails formats the details of an action to a compact, readable summary.
+func formatActionDetails(action *Action) string {
+	switch action.Op {
+	case OpCreate:
+		if action.image != nil {
+			return fmt.Sprintf("%s, %d bytes", strings.ToUpper(action.image.Format), action.image.Size)
+		}
+		return fmt.Sprintf("%s, %d MB", strings.ToUpper(action.vm.Arch), action.vm.Memory)
+	case OpUpdate:
+		return formatMetadataChanges(action.Before, action.After)
+	case OpAttach, OpDetach:
+		return "image " + action.Image
+	case OpDelete:
+		if len(action.detach) > 0 {
+			return "detach " + strings.Join(action.detach, ", ")
+		}
+	}
+	return ""
+}
+
+// formatMetadataChanges formats the keys set (+) and unset (-) between the supplied metadata maps.
+func formatMetadataChanges(before, after map[string]string) string {
+	var changes []string
+	for _, key := range sortedKeys(after) {
+		if old, ok := before[key]; !ok || old != after[key] {
+			changes = append(changes, "+"+key+"="+after[key])
+		}
+	}
+	for _, key := range sortedKeys(before) {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, "-"+key)
+		}
+	}
+
+	return strings.Join(changes, ",")
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testDiskId = "0b1d6a3e-5c4f-4e2a-9d8b-7a6c5e4f3d2c"
+	testOldId  = "1c2e7b4f-6d5a-4f3b-8e9c-8b7d6f5e4a3d"
+	testWebId  = "2d3f8c5a-7e6b-4a4c-9fad-9c8e7a6f5b4e"
+	testGoneId = "3e4a9d6b-8f7c-4b5d-8abe-ad9f8b7a6c5f"
+	testUsedId = "4f5bae7c-9a8d-4c6e-9bcf-beaa9c8b7d6a"
+)
+
+// newTestApplyState creates the state of kitsune with the managed images "disk" and "old", the managed virtual
+// machine "web" with "disk" attached and the managed virtual machine "gone" with "old" attached.
+func newTestApplyState() *applyState {
+	managed := func(name string) map[string]string {
+		return map[string]string{"name": name, ManagedByKey: "kitsh"}
+	}
+	image := func(id string) *v1.Image {
+		return &v1.Image{Id: &v1.UUID{Value: id}, Format: v1.Image_QCOW2, Size: 1024}
+	}
+	vm := func(id string) *v1.VirtualMachine {
+		return &v1.VirtualMachine{Id: &v1.UUID{Value: id}, Arch: v1.Architecture_X86_64, MemorySize: 512}
+	}
+
+	return &applyState{
+		owner:   "kitsh",
+		nameKey: "name",
+		images: map[string]*managedImage{
+			"disk": {image: image(testDiskId), data: managed("disk")},
+			"old":  {image: image(testOldId), data: managed("old")},
+		},
+		vms: map[string]*managedVm{
+			"web":  {vm: vm(testWebId), data: managed("web"), images: []string{"disk"}},
+			"gone": {vm: vm(testGoneId), data: managed("gone"), images: []string{"old"}},
+		},
+		unmanaged:       map[Kind]map[string]bool{KindImage: {"shared": true}, KindVirtualMachine: {"other": true}},
+		protectedImages: make(map[string]*v1.UUID),
+		foreign:         newAttachments(nil, nil),
+	}
+}
+
+// testManifests creates manifests of the "disk" image and the "web" virtual machine with the supplied images.
+func testManifests(images ...string) *Manifests {
+	return &Manifests{
+		Images:          []*ImageManifest{{Name: "disk", Format: "qcow2", Size: 1024}},
+		VirtualMachines: []*VirtualMachineManifest{{Name: "web", Arch: "x86_64", Memory: 512, Images: images}},
+	}
+}
+
+// formatTestAction formats the supplied action compactly for comparisons.
+func formatTestAction(action *Action) string {
+	formatted := string(action.Op) + " " + string(action.Resource) + " " + action.Name
+	if action.Image != "" {
+		formatted += " " + action.Image
+	}
+	if len(action.detach) > 0 {
+		formatted += " detach=" + strings.Join(action.detach, ",")
+	}
+	return formatted
+}
+
+func TestApplyStatePlan(t *testing.T) {
+	tests := []struct {
+		name      string
+		modify    func(s *applyState, m *Manifests)
+		prune     bool
+		want      []string
+		wantExit  int
+		wantError string
+	}{
+		{
+			name: "up to date",
+		},
+		{
+			name:  "prune",
+			prune: true,
+			want:  []string{"delete VirtualMachine gone detach=old", "delete Image old"},
+		},
+		{
+			name: "create",
+			modify: func(s *applyState, m *Manifests) {
+				m.Images = append(m.Images, &ImageManifest{Name: "new", Format: "raw", Size: 2048})
+				m.VirtualMachines = append(m.VirtualMachines, &VirtualMachineManifest{
+					Name: "db", Arch: "aarch64", Memory: 1024, Images: []string{"new", testUsedId},
+				})
+			},
+			want: []string{
+				"create Image new",
+				"create VirtualMachine db",
+				"attach VirtualMachine db new",
+				"attach VirtualMachine db " + testUsedId,
+			},
+		},
+		{
+			name: "update metadata",
+			modify: func(s *applyState, m *Manifests) {
+				m.VirtualMachines[0].Metadata = map[string]string{"env": "prod"}
+			},
+			want: []string{"update VirtualMachine web"},
+		},
+		{
+			name: "keep protection",
+			modify: func(s *applyState, m *Manifests) {
+				s.vms["web"].data[ProtectedKey] = "true"
+			},
+		},
+		{
+			name: "move image",
+			modify: func(s *applyState, m *Manifests) {
+				m.Images = append(m.Images, &ImageManifest{Name: "old", Format: "qcow2", Size: 1024})
+				m.VirtualMachines[0].Images = []string{"old"}
+				m.VirtualMachines = append(m.VirtualMachines, &VirtualMachineManifest{
+					Name: "gone", Arch: "x86_64", Memory: 512, Images: []string{"disk"},
+				})
+			},
+			want: []string{
+				"detach VirtualMachine web disk",
+				"detach VirtualMachine gone old",
+				"attach VirtualMachine web old",
+				"attach VirtualMachine gone disk",
+			},
+		},
+		{
+			name: "image by UUID",
+			modify: func(s *applyState, m *Manifests) {
+				m.VirtualMachines[0].Images = []string{strings.ToUpper(testDiskId)}
+			},
+		},
+		{
+			name: "unmanaged name",
+			modify: func(s *applyState, m *Manifests) {
+				m.Images = append(m.Images, &ImageManifest{Name: "shared", Format: "qcow2", Size: 1024})
+			},
+			wantExit:  ExitInvalidArgument,
+			wantError: "isn't managed by kitsh",
+		},
+		{
+			name: "resize",
+			modify: func(s *applyState, m *Manifests) {
+				m.Images[0].Size = 4096
+			},
+			wantExit:  ExitInvalidArgument,
+			wantError: "can't be changed",
+		},
+		{
+			name: "detach from protected virtual machine",
+			modify: func(s *applyState, m *Manifests) {
+				s.vms["web"].data[ProtectedKey] = "true"
+				m.VirtualMachines[0].Images = nil
+			},
+			wantExit: ExitProtected,
+		},
+		{
+			name: "prune protected virtual machine",
+			modify: func(s *applyState, m *Manifests) {
+				s.vms["gone"].data[ProtectedKey] = "true"
+			},
+			prune:    true,
+			wantExit: ExitProtected,
+		},
+		{
+			name: "prune virtual machine with protected image",
+			modify: func(s *applyState, m *Manifests) {
+				s.protectedImages["old"] = &v1.UUID{Value: testOldId}
+			},
+			prune:    true,
+			wantExit: ExitProtected,
+		},
+		{
+			name: "prune image attached to foreign virtual machine",
+			modify: func(s *applyState, m *Manifests) {
+				s.foreign = newAttachments(
+					[]*v1.VirtualMachine{{Id: &v1.UUID{Value: testUsedId}}},
+					[][]*v1.UUID{{{Value: testOldId}}},
+				)
+			},
+			prune:     true,
+			wantExit:  ExitInvalidArgument,
+			wantError: "is attached to virtual machines " + testUsedId,
+		},
+		{
+			name: "prune image referenced by UUID",
+			modify: func(s *applyState, m *Manifests) {
+				m.VirtualMachines[0].Images = []string{"disk", testOldId}
+			},
+			prune:     true,
+			wantExit:  ExitInvalidArgument,
+			wantError: "references it by UUID",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, manifests := newTestApplyState(), testManifests("disk")
+			if test.modify != nil {
+				test.modify(state, manifests)
+			}
+
+			actions, err := state.plan(manifests, test.prune)
+			if test.wantExit != 0 {
+				if code := ExitCode(err); code != test.wantExit || !strings.Contains(errorString(err), test.wantError) {
+					t.Fatalf("plan() error = %v (exit code %d), want exit code %d containing %q", err, code, test.wantExit, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("plan() failed: %v", err)
+			}
+
+			var got []string
+			for _, action := range actions {
+				got = append(got, formatTestAction(action))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("plan() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// errorString gets the message of the supplied error, or an empty string if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmptyToken is an error about a token file or a credential helper not producing a token.
+var EmptyToken = errors.New("empty token")
+
+// InsecureToken is an error about a bearer token being configured for a plaintext connection.
+var InsecureToken = errors.New("refusing to send the bearer token over a plaintext connection, enable TLS or allow it with --allow-insecure-token")
+
+// AuthConfig are the authentication settings of a context, at most one token source should be set.
+type AuthConfig struct {
+	Token            string `yaml:"token,omitempty" json:"token,omitempty"`
+	TokenFile        string `yaml:"token-file,omitempty" json:"tokenFile,omitempty"`
+	CredentialHelper string `yaml:"credential-helper,omitempty" json:"credentialHelper,omitempty"`
+	// AllowInsecure allows sending the token over plaintext connections, e.g. to an authenticating proxy
+	// on a trusted network. Unix socket targets are always allowed.
+	AllowInsecure bool `yaml:"allow-insecure,omitempty" json:"allowInsecure,omitempty"`
+}
+
+// active checks whether any token source is configured.
+func (c *AuthConfig) active() bool {
+	return c.Token != "" || c.TokenFile != "" || c.CredentialHelper != ""
+}
+
+// redacted returns a copy of the config with the static token hidden, suitable for printing.
+func (c *AuthConfig) redacted() *AuthConfig {
+	redacted := *c
+	if redacted.Token != "" {
+		redacted.Token = "REDACTED"
+	}
+	return &redacted
+}
+
+// helperResponse is the JSON output of a credential helper, helpers may also print just the token.
+type helperResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// tokenCredentials are gRPC per-RPC credentials, attaching a bearer token to every call.
+// The token is obtained lazily from the configured source and cached until it expires or is invalidated.
+type tokenCredentials struct {
+	config AuthConfig
+	target string
+	// insecure allows plaintext connections, see AuthConfig.AllowInsecure.
+	insecure bool
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newTokenCredentials creates per-RPC credentials for the supplied authentication settings and target.
+func newTokenCredentials(config AuthConfig, target string, local bool) *tokenCredentials {
+	return &tokenCredentials{config: config, target: target, insecure: config.AllowInsecure || local}
+}
+
+// GetRequestMetadata gets the "authorization" metadata of a call.
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to obtain token: %s", err)
+	}
+
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity requires TLS, unless plaintext connections are allowed explicitly or the target is local.
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return !c.insecure
+}
+
+// refreshable checks whether obtaining the token again can yield a different token.
+func (c *tokenCredentials) refreshable() bool {
+	return c.config.Token == ""
+}
+
+// invalidate drops the cached token, so that it is obtained again on the next call.
+func (c *tokenCredentials) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = ""
+}
+
+// getToken gets the cached token, obtaining a new one if it is missing or expired.
+func (c *tokenCredentials) getToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return c.token, nil
+	}
+
+	token, expires, err := c.obtainToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", EmptyToken
+	}
+
+	c.token, c.expires = token, expires
+	return token, nil
+}
+
+// obtainToken obtains a token from the configured source, a zero expiry time means it doesn't expire.
+func (c *tokenCredentials) obtainToken(ctx context.Context) (string, time.Time, error) {
+	switch {
+	case c.config.Token != "":
+		return c.config.Token, time.Time{}, nil
+	case c.config.TokenFile != "":
+		data, err := os.ReadFile(c.config.TokenFile)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return strings.TrimSpace(string(data)), time.Time{}, nil
+	}
+
+	return runCredentialHelper(ctx, c.config.CredentialHelper, c.target)
+}
+
+// runCredentialHelper runs the supplied credential helper command with the "get" argument in a shell,
+// like git does. The helper either prints the token or a JSON object with "token" and "expiresAt" (RFC 3339) fields.
+func runCredentialHelper(ctx context.Context, helper, target string) (string, time.Time, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := shellCommand(ctx, helper+" get")
+	cmd.Env = append(os.Environ(), "KITSUNE_TARGET="+target)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", time.Time{}, fmt.Errorf("credential helper failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if bytes.HasPrefix(output, []byte("{")) {
+		res := &helperResponse{}
+		if err := json.Unmarshal(output, res); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid credential helper output: %w", err)
+		}
+		return res.Token, res.ExpiresAt, nil
+	}
+
+	return string(output), time.Time{}, nil
+}
+
+// authUnaryInterceptor produces an interceptor which invalidates the token and retries a unary call once,
+// if the call was rejected as unauthenticated and the token can be refreshed.
+func authUnaryInterceptor(creds *tokenCredentials) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) == codes.Unauthenticated && creds.refreshable() {
+			creds.invalidate()
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		return err
+	}
+}
+
+// authStreamInterceptor produces an interceptor which invalidates the token and re-establishes a stream once,
+// if the stream was rejected as unauthenticated and the token can be refreshed.
+func authStreamInterceptor(creds *tokenCredentials) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		retried := false
+		return newReplayingStream(ctx, desc, cc, method, streamer, opts, func(err error) bool {
+			if retried || status.Code(err) != codes.Unauthenticated || !creds.refreshable() {
+				return false
+			}
+
+			retried = true
+			creds.invalidate()
+			return true
+		})
+	}
+}
+
+// shellCommand creates a command running the supplied command line in the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+
+	return exec.CommandContext(ctx, shell, flag, command)
+}
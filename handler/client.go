@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// InvalidCAFile is an error about a CA file not containing any PEM-encoded certificates.
+var InvalidCAFile = errors.New("no certificates found in CA file")
+
+// IncompleteKeyPair is an error about only one of a client certificate and its private key being supplied.
+var IncompleteKeyPair = errors.New("both a client certificate and its private key must be supplied")
+
+// clientCache is a cache of kitsune clients keyed by their connection settings.
+var clientCache = make(map[Settings]*libkitsune.KitsuneClient)
+
+// newClient creates a kitsune client (or gets a cached one) for the settings resolved from the global flags
+// and the selected context.
+func newClient(cCtx *cli.Context) (*libkitsune.KitsuneClient, error) {
+	settings, err := resolveSettings(cCtx)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Target == "" {
+		return nil, MissingTarget
+	}
+
+	if client, ok := clientCache[*settings]; ok {
+		return client, nil
+	}
+
+	client, err := dial(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCache[*settings] = client
+	return client, nil
+}
+
+// dial connects to the target of the supplied settings and creates a kitsune client with the resulting connection.
+func dial(settings *Settings) (*libkitsune.KitsuneClient, error) {
+	target, err := parseTarget(settings.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := transportCredentials(&settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	grpcTarget, opts := target.dialOptions()
+	opts = append(opts, grpc.WithTransportCredentials(creds))
+
+	var unary []grpc.UnaryClientInterceptor
+	var stream []grpc.StreamClientInterceptor
+
+	if settings.DryRun {
+		unary = append(unary, dryRunUnaryInterceptor(os.Stderr))
+	}
+	if settings.Auth.active() {
+		// checked upfront, gRPC would only fail every call with a cryptic error
+		local := target.Scheme == "unix"
+		if !settings.TLS.active() && !settings.Auth.AllowInsecure && !local {
+			return nil, InsecureToken
+		}
+
+		tokenCreds := newTokenCredentials(settings.Auth, settings.Target, local)
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCreds))
+		unary = append(unary, authUnaryInterceptor(tokenCreds))
+		stream = append(stream, authStreamInterceptor(tokenCreds))
+	}
+
+	// the timeout is applied after retrying, so that it applies to every attempt separately
+	unary = append(unary, retryUnaryInterceptor(settings.Retries, settings.RetryBackoff), timeoutUnaryInterceptor(settings.Timeout))
+	stream = append(stream, retryStreamInterceptor(settings.Retries, settings.RetryBackoff), timeoutStreamInterceptor(settings.Timeout))
+	opts = append(opts, grpc.WithChainUnaryInterceptor(unary...), grpc.WithChainStreamInterceptor(stream...))
+
+	if settings.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                settings.KeepaliveTime,
+			Timeout:             settings.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	conn, err := grpc.Dial(grpcTarget, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", settings.Target, err)
+	}
+
+	return &libkitsune.KitsuneClient{
+		Cc:            conn,
+		ImageRegistry: v1.NewImageRegistryServiceClient(conn),
+		VmRegistry:    v1.NewVirtualMachineRegistryServiceClient(conn),
+	}, nil
+}
+
+// transportCredentials builds the gRPC transport credentials of the supplied TLS settings.
+func transportCredentials(config *TLSConfig) (credentials.TransportCredentials, error) {
+	if !config.active() {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: %s", InvalidCAFile, config.CAFile)
+		}
+	} else {
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, IncompleteKeyPair
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// active checks whether TLS is enabled, either explicitly or implied by any other TLS setting.
+func (c *TLSConfig) active() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify
+}
+
+// timeoutUnaryInterceptor produces an interceptor which applies the supplied timeout to every unary call,
+// a non-positive timeout disables it.
+func timeoutUnaryInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// timeoutStreamInterceptor produces an interceptor which applies the supplied timeout to establishing every stream
+// and to waiting for each of its messages, a non-positive timeout disables it. The stream as a whole isn't limited,
+// so that slowly consumed streams don't time out.
+func timeoutStreamInterceptor(timeout time.Duration) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if timeout <= 0 {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		s := &idleTimeoutStream{cancel: cancel, timeout: timeout}
+		s.timer = time.AfterFunc(timeout, s.expire)
+
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		s.timer.Stop()
+		if err != nil {
+			cancel()
+			return nil, s.timeoutError(err)
+		}
+
+		s.ClientStream = stream
+		return s, nil
+	}
+}
+
+// idleTimeoutStream is a grpc.ClientStream which is cancelled if a message isn't received within the timeout,
+// it releases its context once the stream ends.
+type idleTimeoutStream struct {
+	grpc.ClientStream
+
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+// expire cancels the stream because of the timeout.
+func (s *idleTimeoutStream) expire() {
+	atomic.StoreInt32(&s.expired, 1)
+	s.cancel()
+}
+
+// timeoutError replaces the supplied error with a DeadlineExceeded status if the timeout expired.
+func (s *idleTimeoutStream) timeoutError(err error) error {
+	if atomic.LoadInt32(&s.expired) == 0 {
+		return err
+	}
+	return status.Errorf(codes.DeadlineExceeded, "no response within %s", s.timeout)
+}
+
+// RecvMsg receives a message within the timeout, releasing the stream context on any error (including io.EOF).
+func (s *idleTimeoutStream) RecvMsg(m interface{}) error {
+	s.timer.Reset(s.timeout)
+	err := s.ClientStream.RecvMsg(m)
+	s.timer.Stop()
+
+	if err != nil {
+		s.cancel()
+		if err != io.EOF {
+			err = s.timeoutError(err)
+		}
+	}
+	return err
+}
+
+// replayingStream is a grpc.ClientStream which is re-established as long as no message has been received yet
+// and the retry callback permits it, replaying all messages sent so far.
+type replayingStream struct {
+	grpc.ClientStream
+
+	ctx      context.Context
+	desc     *grpc.StreamDesc
+	cc       *grpc.ClientConn
+	method   string
+	streamer grpc.Streamer
+	opts     []grpc.CallOption
+	retry    func(err error) bool
+
+	sent     []interface{}
+	closed   bool
+	received bool
+}
+
+// newReplayingStream establishes a replayingStream, retrying the establishment itself as permitted by the callback.
+func newReplayingStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts []grpc.CallOption, retry func(err error) bool) (grpc.ClientStream, error) {
+	s := &replayingStream{ctx: ctx, desc: desc, cc: cc, method: method, streamer: streamer, opts: opts, retry: retry}
+	for {
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err == nil {
+			s.ClientStream = stream
+			return s, nil
+		}
+		if !retry(err) {
+			return nil, err
+		}
+	}
+}
+
+// SendMsg sends a message, remembering it for replaying.
+func (s *replayingStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+	return s.ClientStream.SendMsg(m)
+}
+
+// CloseSend closes the sending direction of the stream, remembering it for replaying.
+func (s *replayingStream) CloseSend() error {
+	s.closed = true
+	return s.ClientStream.CloseSend()
+}
+
+// RecvMsg receives a message, re-establishing the stream on errors before the first message, if permitted.
+func (s *replayingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	for err != nil && err != io.EOF && !s.received && s.retry(err) {
+		if err = s.reestablish(); err == nil {
+			err = s.ClientStream.RecvMsg(m)
+		}
+	}
+
+	if err == nil {
+		s.received = true
+	}
+	return err
+}
+
+// reestablish creates a new stream and replays all messages sent so far.
+func (s *replayingStream) reestablish() error {
+	stream, err := s.streamer(s.ctx, s.desc, s.cc, s.method, s.opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range s.sent {
+		if err := stream.SendMsg(m); err != nil {
+			return err
+		}
+	}
+	if s.closed {
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+	}
+
+	s.ClientStream = stream
+	return nil
+}
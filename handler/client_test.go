@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate along with its private key and the paths of their PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert generates a certificate from the supplied template, signed by the supplied parent or self-signed
+// if it is nil, and writes it and its key to PEM files in dir.
+func newTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testPKI are the certificates of a test CA, a server and a client, along with a CA unrelated to them.
+type testPKI struct {
+	ca, server, client, other *testCert
+}
+
+// newTestPKI generates a testPKI, the server certificate is valid for localhost and 127.0.0.1.
+func newTestPKI(t *testing.T) *testPKI {
+	dir := t.TempDir()
+	ca := func() *x509.Certificate {
+		return &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	}
+
+	pki := &testPKI{ca: newTestCert(t, dir, "ca", ca(), nil), other: newTestCert(t, dir, "other", ca(), nil)}
+	pki.server = newTestCert(t, dir, "server", &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, pki.ca)
+	pki.client = newTestCert(t, dir, "client", &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, pki.ca)
+	return pki
+}
+
+// aliveServer is a virtual machine registry reporting every virtual machine as running.
+type aliveServer struct {
+	v1.UnimplementedVirtualMachineRegistryServiceServer
+}
+
+func (aliveServer) IsAlive(context.Context, *v1.IsAliveRequest) (*v1.IsAliveResponse, error) {
+	return &v1.IsAliveResponse{AliveOrError: &v1.IsAliveResponse_Alive{Alive: true}}, nil
+}
+
+// serveTLS starts a gRPC server with aliveServer on a random local port, requiring client certificates
+// signed by the CA of the supplied testPKI. It returns the address of the server.
+func serveTLS(t *testing.T, pki *testPKI) string {
+	t.Helper()
+
+	cert, err := tls.LoadX509KeyPair(pki.server.certFile, pki.server.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(pki.ca.cert)
+
+	return serve(t, "tcp", "127.0.0.1:0", grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+}
+
+// serve starts a gRPC server with aliveServer and the supplied options on the supplied address,
+// returning the address it listens on.
+func serve(t *testing.T, network, address string, opts ...grpc.ServerOption) string {
+	t.Helper()
+
+	return serveWith(t, network, address, func(server *grpc.Server) {
+		v1.RegisterVirtualMachineRegistryServiceServer(server, aliveServer{})
+	}, opts...)
+}
+
+// serveWith starts a gRPC server with the services registered by the supplied callback and the supplied options
+// on the supplied address, returning the address it listens on.
+func serveWith(t *testing.T, network, address string, register func(server *grpc.Server), opts ...grpc.ServerOption) string {
+	t.Helper()
+
+	server := grpc.NewServer(opts...)
+	register(server)
+
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	return lis.Addr().String()
+}
+
+func TestTransportCredentials(t *testing.T) {
+	pki := newTestPKI(t)
+	notPem := filepath.Join(t.TempDir(), "not.pem")
+	if err := os.WriteFile(notPem, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		config   TLSConfig
+		protocol string
+		wantErr  error
+	}{
+		{"disabled", TLSConfig{}, "insecure", nil},
+		{"enabled", TLSConfig{Enabled: true}, "tls", nil},
+		{"implied by server name", TLSConfig{ServerName: "kitsune"}, "tls", nil},
+		{"mutual", TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile}, "tls", nil},
+		{"invalid CA file", TLSConfig{CAFile: notPem}, "", InvalidCAFile},
+		{"missing CA file", TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, "", os.ErrNotExist},
+		{"certificate only", TLSConfig{CertFile: pki.client.certFile}, "", IncompleteKeyPair},
+		{"key only", TLSConfig{KeyFile: pki.client.keyFile}, "", IncompleteKeyPair},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			creds, err := transportCredentials(&test.config)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("transportCredentials() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("transportCredentials() failed: %v", err)
+			}
+			if protocol := creds.Info().SecurityProtocol; protocol != test.protocol {
+				t.Errorf("transportCredentials() protocol = %s, want %s", protocol, test.protocol)
+			}
+		})
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := serveTLS(t, pki)
+
+	tests := []struct {
+		name   string
+		config TLSConfig
+		ok     bool
+	}{
+		{"mutual", TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile}, true},
+		{"server name", TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile, ServerName: "localhost"}, true},
+		{"skip verify", TLSConfig{InsecureSkipVerify: true, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile}, true},
+		{"wrong server name", TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile, ServerName: "kitsune"}, false},
+		{"unknown CA", TLSConfig{CAFile: pki.other.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile}, false},
+		{"no client certificate", TLSConfig{CAFile: pki.ca.certFile}, false},
+		{"untrusted client certificate", TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.other.certFile, KeyFile: pki.other.keyFile}, false},
+		{"plaintext", TLSConfig{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := dial(&Settings{Target: addr, TLS: test.config, Timeout: 5 * time.Second})
+			if err != nil {
+				t.Fatalf("dial() failed: %v", err)
+			}
+			defer client.Cc.Close()
+
+			res, err := client.VmRegistry.IsAlive(context.Background(), &v1.IsAliveRequest{Id: &v1.UUID{Value: testId}})
+			if test.ok && (err != nil || !res.GetAlive()) {
+				t.Errorf("IsAlive() = %v, %v, want a running virtual machine", res, err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("IsAlive() succeeded, want a failed handshake")
+			}
+			if !test.ok && ExitCode(err) != ExitConnection {
+				t.Errorf("IsAlive() exit code = %d, want %d", ExitCode(err), ExitConnection)
+			}
+		})
+	}
+}
+
+func TestDialToken(t *testing.T) {
+	pki := newTestPKI(t)
+	tlsAddr := serveTLS(t, pki)
+	plaintextAddr := serve(t, "tcp", "127.0.0.1:0")
+	socket := "unix://" + serve(t, "unix", filepath.Join(t.TempDir(), "kitsune.sock"))
+	mutual := TLSConfig{CAFile: pki.ca.certFile, CertFile: pki.client.certFile, KeyFile: pki.client.keyFile}
+
+	tests := []struct {
+		name     string
+		target   string
+		tls      TLSConfig
+		auth     AuthConfig
+		wantErr  error
+		wantCall bool
+	}{
+		{"TLS", tlsAddr, mutual, AuthConfig{Token: "secret"}, nil, true},
+		{"plaintext", plaintextAddr, TLSConfig{}, AuthConfig{Token: "secret"}, InsecureToken, false},
+		{"plaintext token file", plaintextAddr, TLSConfig{}, AuthConfig{TokenFile: "token"}, InsecureToken, false},
+		{"plaintext allowed", plaintextAddr, TLSConfig{}, AuthConfig{Token: "secret", AllowInsecure: true}, nil, true},
+		{"plaintext without token", plaintextAddr, TLSConfig{}, AuthConfig{}, nil, true},
+		{"unix socket", socket, TLSConfig{}, AuthConfig{Token: "secret"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := dial(&Settings{Target: test.target, TLS: test.tls, Auth: test.auth, Timeout: 5 * time.Second})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("dial() error = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer client.Cc.Close()
+
+			res, err := client.VmRegistry.IsAlive(context.Background(), &v1.IsAliveRequest{Id: &v1.UUID{Value: testId}})
+			if err != nil || !res.GetAlive() {
+				t.Errorf("IsAlive() = %v, %v, want a running virtual machine", res, err)
+			}
+		})
+	}
+}
+
+// delayedStream is a grpc.ClientStream sending the supplied number of messages, each after the supplied delay.
+type delayedStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	delay    time.Duration
+	messages int
+}
+
+func (s *delayedStream) RecvMsg(interface{}) error {
+	select {
+	case <-time.After(s.delay):
+	case <-s.ctx.Done():
+		return status.Error(codes.Canceled, s.ctx.Err().Error())
+	}
+
+	if s.messages == 0 {
+		return io.EOF
+	}
+	s.messages--
+	return nil
+}
+
+func TestTimeoutStreamInterceptor(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		setupDelay   time.Duration
+		messageDelay time.Duration
+		consumeDelay time.Duration
+		want         codes.Code
+	}{
+		{"fast", 0, 0, 0, codes.OK},
+		{"slow consumer", 0, 0, 2 * timeout, codes.OK},
+		{"longer than the timeout in total", 0, timeout / 2, 0, codes.OK},
+		{"slow setup", 2 * timeout, 0, 0, codes.DeadlineExceeded},
+		{"slow message", 0, 2 * timeout, 0, codes.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			streamer := func(ctx context.Context, _ *grpc.StreamDesc, _ *grpc.ClientConn, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+				select {
+				case <-time.After(test.setupDelay):
+				case <-ctx.Done():
+					return nil, status.Error(codes.Canceled, ctx.Err().Error())
+				}
+				return &delayedStream{ctx: ctx, delay: test.messageDelay, messages: 4}, nil
+			}
+
+			stream, err := timeoutStreamInterceptor(timeout)(context.Background(), &grpc.StreamDesc{}, nil, "/s/GetImages", streamer)
+			for err == nil {
+				if err = stream.RecvMsg(nil); err == nil {
+					time.Sleep(test.consumeDelay)
+				}
+			}
+			if err == io.EOF {
+				err = nil
+			}
+
+			if code := status.Code(err); code != test.want {
+				t.Errorf("stream error = %v, want %s", err, test.want)
+			}
+			if test.want != codes.OK && ExitCode(err) != ExitConnection {
+				t.Errorf("stream exit code = %d, want %d", ExitCode(err), ExitConnection)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// CloneVirtualMachine is a handler for the "vm clone" command.
+func CloneVirtualMachine(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	nameKey := cCtx.String("name-key")
+	if cCtx.IsSet("name") && nameKey == "" {
+		return MissingNameKey
+	}
+
+	overrides, err := metadataFlags(cCtx)
+	if err != nil {
+		return err
+	}
+
+	srcId, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
+	if err != nil {
+		return err
+	}
+
+	var (
+		src      *v1.VirtualMachine
+		srcData  map[string]string
+		imageIds []*v1.UUID
+	)
+	err = runConcurrently(
+		func() (err error) {
+			src, err = findVirtualMachine(cCtx.Context, client.VmRegistry, srcId)
+			return
+		},
+		func() (err error) {
+			srcData, err = fetchMetadata(cCtx.Context, client.VmRegistry, srcId)
+			return
+		},
+		func() (err error) {
+			imageIds, err = fetchAttachedImageIds(cCtx.Context, client.VmRegistry, srcId)
+			return
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// an image deleted in the meantime fails the clone with a not found error, instead of being cloned empty
+	images := make([]*v1.Image, len(imageIds))
+	imageData := make([]map[string]string, len(imageIds))
+	tasks := make([]func() error, 2*len(imageIds))
+	for i, imageId := range imageIds {
+		i, imageId := i, imageId
+		tasks[2*i] = func() (err error) {
+			images[i], err = findImage(cCtx.Context, client.ImageRegistry, imageId)
+			return
+		}
+		tasks[2*i+1] = func() (err error) {
+			imageData[i], err = fetchMetadata(cCtx.Context, client.ImageRegistry, imageId)
+			return
+		}
+	}
+	if err := runConcurrently(tasks...); err != nil {
+		return err
+	}
+
+	// names, ownership and protection aren't cloned, a clone is neither managed by kitsh apply, named like its source
+	// nor protected from deletion
+	data := cloneMetadata(srcData, nameKey)
+	for key, value := range overrides {
+		data[key] = value
+	}
+	if cCtx.IsSet("name") {
+		data[nameKey] = cCtx.String("name")
+	}
+
+	rb := &rollback{}
+	vm, err := createVirtualMachine(cCtx.Context, client, src.GetArch(), src.GetMemorySize(), data)
+	if err != nil {
+		return err
+	}
+	vmId := vm.GetId()
+	rb.add("delete virtual machine "+vmId.GetValue(), func(ctx context.Context) error {
+		return deleteVirtualMachine(ctx, client, vmId)
+	})
+
+	for i, image := range images {
+		if _, err := attachNewImage(cCtx.Context, client, rb, vmId, image.GetFormat(), image.GetSize(), cloneMetadata(imageData[i], nameKey)); err != nil {
+			return rb.run(fmt.Errorf("failed to clone image %s: %w", image.GetId().GetValue(), err))
+		}
+	}
+
+	out := NewOutput(KindVirtualMachine, "ID", "Architecture", "Memory size")
+	out.Add(
+		vm,
+		vm.GetId().GetValue(),
+		vm.GetArch(),
+		vm.GetMemorySize(),
+	)
+
+	return out.Render(cCtx)
+}
+
+// attachNewImage creates an image and attaches it to the supplied virtual machine, recording both steps in rb.
+func attachNewImage(
+	ctx context.Context,
+	client *libkitsune.KitsuneClient,
+	rb *rollback,
+	vmId *v1.UUID,
+	format v1.Image_Format,
+	size uint64,
+	data map[string]string,
+) (*v1.Image, error) {
+	image, err := createImage(ctx, client, format, size, data)
+	if err != nil {
+		return nil, err
+	}
+	rb.add("delete image "+image.GetId().GetValue(), func(ctx context.Context) error {
+		return deleteImage(ctx, client, image.GetId())
+	})
+
+	return image, attachExistingImage(ctx, client, rb, vmId, image.GetId())
+}
+
+// attachExistingImage attaches the supplied image to the supplied virtual machine, recording the step in rb.
+func attachExistingImage(ctx context.Context, client *libkitsune.KitsuneClient, rb *rollback, vmId, imageId *v1.UUID) error {
+	if err := attachImage(ctx, client, OpAttach, vmId, imageId); err != nil {
+		return fmt.Errorf("failed to attach image %s: %w", imageId.GetValue(), err)
+	}
+	rb.add("detach image "+imageId.GetValue(), func(ctx context.Context) error {
+		return attachImage(ctx, client, OpDetach, vmId, imageId)
+	})
+
+	return nil
+}
+
+// cloneMetadata copies the supplied metadata without the name, the kitsh.managed-by and the kitsh.protected keys.
+func cloneMetadata(data map[string]string, nameKey string) map[string]string {
+	return copyMetadata(data, nameKey, ManagedByKey, ProtectedKey)
+}
+
+// copyMetadata copies the supplied metadata without the supplied keys.
+func copyMetadata(data map[string]string, skip ...string) map[string]string {
+	copied := make(map[string]string, len(data))
+	for key, value := range data {
+		if !containsString(skip, key) {
+			copied[key] = value
+		}
+	}
+
+	return copied
+}
@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCloneMetadata(t *testing.T) {
+	data := map[string]string{"name": "web", ManagedByKey: "kitsh", ProtectedKey: "true", "env": "prod"}
+
+	if got, want := cloneMetadata(data, "name"), map[string]string{"env": "prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cloneMetadata() = %v, want %v", got, want)
+	}
+	if got, want := exportMetadata(data, "name"), map[string]string{ProtectedKey: "true", "env": "prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exportMetadata() = %v, want %v", got, want)
+	}
+	if got := cloneMetadata(nil, ""); got == nil || len(got) != 0 {
+		t.Errorf("cloneMetadata() = %#v, want an empty map", got)
+	}
+}
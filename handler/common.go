@@ -2,14 +2,19 @@ package handler
 
 import (
 	"errors"
-	"fmt"
 	"github.com/fatih/color"
-	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"sync"
 )
 
+// MissingTarget is an error about no kitsune target being supplied.
+var MissingTarget = errors.New("no kitsune target supplied, use --target, $KITSUNE_TARGET or a context")
+
 // SuccessColor is a customizable green color printer.
 var SuccessColor = color.New(color.FgGreen)
 
+// WarningColor is a customizable yellow color printer.
+var WarningColor = color.New(color.FgYellow)
+
 // ErrorColor is a customizable red color printer.
 var ErrorColor = color.New(color.FgRed)
 
@@ -18,10 +23,38 @@ var PrintSuccess = SuccessColor.PrintfFunc()
 
 // PrintError is a Printf-compatible func for ErrorColor.
 func PrintError(format string, a ...interface{}) {
-	_, _ = ErrorColor.Fprintf(color.Error, format, a)
+	_, _ = ErrorColor.Fprintf(color.Error, format, a...)
+}
+
+// runConcurrently runs the supplied tasks concurrently and waits for all of them,
+// returning the error of the first failed task in the supplied order.
+func runConcurrently(tasks ...func() error) error {
+	return runConcurrentlyLimit(len(tasks), tasks...)
 }
 
-// formatError formats a kitsune.proto.v1.Error to a readable Go error.
-func formatError(e *v1.Error) error {
-	return errors.New(fmt.Sprintf("%s: %s", e.GetType(), e.GetMsg()))
+// runConcurrentlyLimit runs the supplied tasks with at most limit of them running concurrently and waits for all
+// of them, returning the error of the first failed task in the supplied order.
+func runConcurrentlyLimit(limit int, tasks ...func() error) error {
+	errs := make([]error, len(tasks))
+	sem := make(chan struct{}, limit)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(tasks))
+	for i, task := range tasks {
+		sem <- struct{}{}
+		go func(i int, task func() error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errs[i] = task()
+		}(i, task)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UnknownContext is an error about a context missing from the config file.
+var UnknownContext = errors.New("unknown context")
+
+// ContextExists is an error about adding a context with a name that is already taken.
+var ContextExists = errors.New("context already exists")
+
+// Config is the kitsh configuration file, a collection of named contexts.
+type Config struct {
+	CurrentContext string           `yaml:"current-context,omitempty"`
+	Contexts       []*ConfigContext `yaml:"contexts"`
+}
+
+// ConfigContext is a named set of connection and output settings.
+type ConfigContext struct {
+	Name    string      `yaml:"name" json:"name"`
+	Target  string      `yaml:"target" json:"target"`
+	TLS     *TLSConfig  `yaml:"tls,omitempty" json:"tls,omitempty"`
+	Auth    *AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
+	Output  string      `yaml:"output,omitempty" json:"output,omitempty"`
+	Timeout string      `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// TLSConfig are the TLS settings of a context.
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled"`
+	CAFile             string `yaml:"ca-file,omitempty" json:"caFile,omitempty"`
+	CertFile           string `yaml:"cert,omitempty" json:"cert,omitempty"`
+	KeyFile            string `yaml:"key,omitempty" json:"key,omitempty"`
+	ServerName         string `yaml:"server-name,omitempty" json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify,omitempty" json:"insecureSkipVerify,omitempty"`
+}
+
+// Settings are the effective connection settings, resolved from the global flags and the selected context.
+type Settings struct {
+	Target           string
+	TLS              TLSConfig
+	Auth             AuthConfig
+	Timeout          time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// DryRun prints the requests of calls modifying state instead of sending them.
+	DryRun bool
+}
+
+// configPath gets the path of the config file, either from the "config" flag or the default location.
+func configPath(cCtx *cli.Context) (string, error) {
+	if path := cCtx.String("config"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "kitsh", "config"), nil
+}
+
+// loadConfig reads the config file, returning an empty Config if it does not exist.
+func loadConfig(cCtx *cli.Context) (*Config, error) {
+	path, err := configPath(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// saveConfig writes the supplied Config to the config file, creating its parent directories if needed.
+func saveConfig(cCtx *cli.Context, config *Config) error {
+	path, err := configPath(cCtx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// Find finds a context by its name, returning nil if it does not exist.
+func (c *Config) Find(name string) *ConfigContext {
+	for _, ctx := range c.Contexts {
+		if ctx.Name == name {
+			return ctx
+		}
+	}
+	return nil
+}
+
+// selectedContext gets the context selected by the "context" flag, or the current context of the config file.
+// It returns nil if no context is selected.
+func selectedContext(cCtx *cli.Context) (*ConfigContext, error) {
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cCtx.String("context")
+	if name == "" {
+		name = config.CurrentContext
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	ctx := config.Find(name)
+	if ctx == nil {
+		return nil, fmt.Errorf("%w: %s", UnknownContext, name)
+	}
+
+	return ctx, nil
+}
+
+// resolveSettings resolves the effective connection settings, explicitly set global flags take precedence over
+// the selected context.
+func resolveSettings(cCtx *cli.Context) (*Settings, error) {
+	cCtx = globalContext(cCtx) // don't pick up command flags sharing a name with a global flag, like "key"
+
+	settings := &Settings{
+		Target:           cCtx.String("target"),
+		Timeout:          cCtx.Duration("timeout"),
+		Retries:          cCtx.Int("retries"),
+		RetryBackoff:     cCtx.Duration("retry-backoff"),
+		KeepaliveTime:    cCtx.Duration("keepalive-time"),
+		KeepaliveTimeout: cCtx.Duration("keepalive-timeout"),
+		DryRun:           cCtx.Bool("dry-run"),
+	}
+
+	ctx, err := selectedContext(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx != nil {
+		if settings.Target == "" {
+			settings.Target = ctx.Target
+		}
+		if ctx.TLS != nil {
+			settings.TLS = *ctx.TLS
+		}
+		if ctx.Auth != nil {
+			settings.Auth = *ctx.Auth
+		}
+		if ctx.Timeout != "" && !cCtx.IsSet("timeout") { // the flag default is overridden, an explicit flag isn't
+			if settings.Timeout, err = time.ParseDuration(ctx.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout in context %s: %w", ctx.Name, err)
+			}
+		}
+	}
+
+	overrideBool(cCtx, "ssl", &settings.TLS.Enabled)
+	overrideString(cCtx, "ca-file", &settings.TLS.CAFile)
+	overrideString(cCtx, "cert", &settings.TLS.CertFile)
+	overrideString(cCtx, "key", &settings.TLS.KeyFile)
+	overrideString(cCtx, "server-name", &settings.TLS.ServerName)
+	overrideBool(cCtx, "insecure-skip-verify", &settings.TLS.InsecureSkipVerify)
+
+	// a token source supplied by flags replaces all token sources of the context
+	if cCtx.IsSet("token") || cCtx.IsSet("token-file") || cCtx.IsSet("credential-helper") {
+		settings.Auth = AuthConfig{
+			Token:            cCtx.String("token"),
+			TokenFile:        cCtx.String("token-file"),
+			CredentialHelper: cCtx.String("credential-helper"),
+		}
+	}
+	overrideBool(cCtx, "allow-insecure-token", &settings.Auth.AllowInsecure)
+
+	return settings, nil
+}
+
+// globalContext gets the context of the app itself, whose flags are the global flags only.
+func globalContext(cCtx *cli.Context) *cli.Context {
+	global := cCtx
+	for _, ctx := range cCtx.Lineage() {
+		if ctx.App != nil { // the app context is wrapped by a context without an app
+			global = ctx
+		}
+	}
+	return global
+}
+
+// isSetLocally checks whether the supplied flag of the command of the supplied context is set. Unlike cCtx.IsSet,
+// it doesn't pick up flags of parent commands or global flags sharing the name, like "key".
+func isSetLocally(cCtx *cli.Context, name string) bool {
+	if cCtx.Command == nil {
+		return false
+	}
+
+	for _, flag := range cCtx.Command.Flags {
+		for _, flagName := range flag.Names() {
+			if flagName == name {
+				return cCtx.IsSet(name)
+			}
+		}
+	}
+	return false
+}
+
+// overrideString replaces the supplied value with the value of the supplied flag, if it was set.
+func overrideString(cCtx *cli.Context, name string, value *string) {
+	if cCtx.IsSet(name) {
+		*value = cCtx.String(name)
+	}
+}
+
+// overrideBool replaces the supplied value with the value of the supplied flag, if it was set.
+func overrideBool(cCtx *cli.Context, name string, value *bool) {
+	if cCtx.IsSet(name) {
+		*value = cCtx.Bool(name)
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveSettings(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(config, []byte(`
+contexts:
+  - name: slow
+    target: slow:8080
+    timeout: 2m
+    auth:
+      token: secret
+      allow-insecure: true
+  - name: unlimited
+    target: unlimited:8080
+    timeout: 0s
+  - name: plain
+    target: plain:8080
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		timeout       time.Duration
+		allowInsecure bool
+	}{
+		{"default", []string{"--context", "plain"}, 30 * time.Second, false},
+		{"context", []string{"--context", "slow"}, 2 * time.Minute, true},
+		{"context disabled", []string{"--context", "unlimited"}, 0, false},
+		{"flag over context", []string{"--context", "slow", "--timeout", "5s"}, 5 * time.Second, true},
+		{"flag disabled", []string{"--context", "plain", "--timeout", "0"}, 0, false},
+		{"flag token over context", []string{"--context", "slow", "--token", "other"}, 2 * time.Minute, false},
+		{"flag allow insecure", []string{"--context", "plain", "--allow-insecure-token"}, 30 * time.Second, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var settings *Settings
+			app := &cli.App{
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "config", Value: config},
+					&cli.StringFlag{Name: "context"},
+					&cli.StringFlag{Name: "target"},
+					&cli.StringFlag{Name: "token"},
+					&cli.BoolFlag{Name: "allow-insecure-token"},
+					&cli.DurationFlag{Name: "timeout", Value: 30 * time.Second},
+				},
+				Commands: []*cli.Command{
+					{
+						Name: "run",
+						Action: func(cCtx *cli.Context) (err error) {
+							settings, err = resolveSettings(cCtx)
+							return
+						},
+					},
+				},
+			}
+
+			if err := app.Run(append(append([]string{"kitsh"}, test.args...), "run")); err != nil {
+				t.Fatalf("resolveSettings() failed: %v", err)
+			}
+			if settings.Timeout != test.timeout {
+				t.Errorf("timeout = %s, want %s", settings.Timeout, test.timeout)
+			}
+			if settings.Auth.AllowInsecure != test.allowInsecure {
+				t.Errorf("allow insecure = %t, want %t", settings.Auth.AllowInsecure, test.allowInsecure)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"strings"
+)
+
+// ConfirmationRequired is returned by destructive commands if stdin is not a terminal and --yes is not set.
+var ConfirmationRequired = errors.New("refusing to continue without confirmation, stdin is not a terminal (use --yes)")
+
+// ConfirmationDeclined is returned by destructive commands if the confirmation prompt was declined.
+var ConfirmationDeclined = errors.New("cancelled, nothing was changed")
+
+// isTerminal checks whether the supplied reader is a terminal, replaced in tests.
+var isTerminal = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	return ok && (isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd()))
+}
+
+// confirmation describes what a destructive command is about to do, for confirming it interactively.
+type confirmation struct {
+	// verb is what is done to the targets, e.g. "delete" or "clear the metadata of".
+	verb string
+	kind Kind
+	ids  []*v1.UUID
+	// details are additional lines printed below a target, optional.
+	details func(id *v1.UUID) []string
+}
+
+// confirmTarget is a target of a confirmation, as presented to the user.
+type confirmTarget struct {
+	id         *v1.UUID
+	name       string
+	production bool
+	summary    string
+}
+
+// confirm asks the user to confirm the supplied destructive operation, unless the "yes" or "dry-run" flag is set.
+// Production resources, matched by the "production-selector" flag, must be confirmed by typing their name (or UUID).
+func confirm(cCtx *cli.Context, client *libkitsune.KitsuneClient, c *confirmation) error {
+	if cCtx.Bool("yes") || cCtx.Bool("dry-run") || len(c.ids) == 0 {
+		return nil
+	}
+	if !isTerminal(cCtx.App.Reader) {
+		return ConfirmationRequired
+	}
+
+	production, err := ParseSelector(cCtx.String("production-selector"))
+	if err != nil {
+		return err
+	}
+
+	targets, err := confirmTargets(cCtx, client, c, production)
+	if err != nil {
+		return err
+	}
+
+	noun := resourceNoun(c.kind)
+	if len(targets) > 1 {
+		noun += "s"
+	}
+	w := cCtx.App.ErrWriter
+	fmt.Fprintf(w, "You are about to %s %d %s:\n", c.verb, len(targets), noun)
+	for _, target := range targets {
+		fmt.Fprintf(w, "  %s\n", target.summary)
+		if c.details != nil {
+			for _, line := range c.details(target.id) {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+
+	reader := bufio.NewReader(cCtx.App.Reader)
+	confirmed := false
+	for _, target := range targets {
+		if !target.production {
+			continue
+		}
+
+		expected := target.name
+		if expected == "" {
+			expected = target.id.GetValue()
+		}
+		answer, err := prompt(w, reader, fmt.Sprintf("%s is labelled as production, type %q to confirm: ", formatNamedId(target.id, target.name), expected))
+		if err != nil {
+			return err
+		}
+		if answer != expected {
+			return ConfirmationDeclined
+		}
+		confirmed = true
+	}
+
+	if !confirmed {
+		answer, err := prompt(w, reader, "Continue? [y/N]: ")
+		if err != nil {
+			return err
+		}
+		if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+			return ConfirmationDeclined
+		}
+	}
+
+	return nil
+}
+
+// confirmTargets fetches what the user needs to know about the targets of the supplied confirmation:
+// names, running status and attachments.
+func confirmTargets(cCtx *cli.Context, client *libkitsune.KitsuneClient, c *confirmation, production Selector) ([]*confirmTarget, error) {
+	registry, relatedRegistry := MetadatableRegistry(client.VmRegistry), MetadatableRegistry(client.ImageRegistry)
+	if c.kind != KindVirtualMachine {
+		registry, relatedRegistry = relatedRegistry, registry
+	}
+
+	var (
+		att   *attachments
+		data  []map[string]string
+		alive = make([]bool, len(c.ids))
+	)
+	tasks := []func() error{
+		func() (err error) {
+			att, err = fetchAttachments(cCtx.Context, client)
+			return
+		},
+		func() (err error) {
+			data, err = fetchAllMetadata(cCtx.Context, registry, c.ids)
+			return
+		},
+	}
+	if c.kind == KindVirtualMachine {
+		for i, id := range c.ids {
+			i, id := i, id
+			tasks = append(tasks, func() (err error) {
+				alive[i], err = isAlive(cCtx.Context, client, id)
+				if isNotFound(err) {
+					return nil // deleted in the meantime
+				}
+				return
+			})
+		}
+	}
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return nil, err
+	}
+
+	// images attached to the virtual machines or virtual machines using the images
+	related := make([][]*v1.UUID, len(c.ids))
+	for i, id := range c.ids {
+		if c.kind == KindVirtualMachine {
+			related[i] = att.vmImages[id.GetValue()]
+		} else {
+			related[i] = att.imageVms[id.GetValue()]
+		}
+	}
+
+	nameKey := cCtx.String("name-key")
+	relatedData := make(map[string]map[string]string)
+	if nameKey != "" {
+		var ids []*v1.UUID
+		for _, relatedIds := range related {
+			for _, id := range relatedIds {
+				if !containsId(ids, id) {
+					ids = append(ids, id)
+				}
+			}
+		}
+
+		fetched, err := fetchAllMetadata(cCtx.Context, relatedRegistry, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, id := range ids {
+			relatedData[id.GetValue()] = fetched[i]
+		}
+	}
+
+	targets := make([]*confirmTarget, len(c.ids))
+	for i, id := range c.ids {
+		var summary []string
+		if c.kind == KindVirtualMachine {
+			summary = append(summary, formatStatus(alive[i]))
+			if len(related[i]) > 0 {
+				summary = append(summary, "images: "+formatNamedIds(related[i], relatedData, nameKey))
+			} else {
+				summary = append(summary, "no images")
+			}
+		} else {
+			if len(related[i]) > 0 {
+				summary = append(summary, "attached to: "+formatNamedIds(related[i], relatedData, nameKey))
+			} else {
+				summary = append(summary, "not attached")
+			}
+		}
+
+		target := &confirmTarget{id: id, production: data[i] != nil && production.Matches(data[i])}
+		if nameKey != "" {
+			target.name = data[i][nameKey]
+		}
+
+		target.summary = formatNamedId(id, target.name) + ", " + strings.Join(summary, ", ")
+		if target.production {
+			target.summary += ErrorColor.Sprint(" [production]")
+		}
+		targets[i] = target
+	}
+
+	return targets, nil
+}
+
+// formatNamedIds formats the supplied UUIDs along with the names found in the supplied metadata.
+func formatNamedIds(ids []*v1.UUID, data map[string]map[string]string, nameKey string) string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		name := ""
+		if nameKey != "" {
+			name = data[id.GetValue()][nameKey]
+		}
+		formatted[i] = formatNamedId(id, name)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// formatNamedId formats the supplied UUID along with the supplied name, if any.
+func formatNamedId(id *v1.UUID, name string) string {
+	if name == "" {
+		return id.GetValue()
+	}
+	return fmt.Sprintf("%s (%s)", name, id.GetValue())
+}
+
+// prompt prints the supplied prompt to the supplied writer and reads a line from the supplied reader.
+func prompt(w io.Writer, reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Fprint(w, prompt)
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", ConfirmationDeclined
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
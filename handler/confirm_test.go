@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"io"
+	"strings"
+	"testing"
+)
+
+// runConfirm runs confirm in a command with the supplied arguments, reading answers from the supplied input.
+// It returns what was printed to stderr.
+func runConfirm(t *testing.T, client *libkitsune.KitsuneClient, c *confirmation, terminal bool, input string, args ...string) (string, error) {
+	t.Helper()
+
+	isTerminalBefore := isTerminal
+	isTerminal = func(io.Reader) bool { return terminal }
+	t.Cleanup(func() { isTerminal = isTerminalBefore })
+
+	var stderr bytes.Buffer
+	app := &cli.App{
+		Name: "kitsh",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "dry-run"},
+			&cli.StringFlag{Name: "name-key", Value: "name"},
+			&cli.StringFlag{Name: "production-selector", Value: "env in (prod,production)"},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "delete",
+				Flags: []cli.Flag{&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}}},
+				Action: func(cCtx *cli.Context) error {
+					return confirm(cCtx, client, c)
+				},
+			},
+		},
+		Reader:         strings.NewReader(input),
+		ErrWriter:      &stderr,
+		ExitErrHandler: func(*cli.Context, error) {},
+	}
+	err := app.Run(append([]string{"kitsh"}, args...))
+
+	return stderr.String(), err
+}
+
+// newConfirmKitsune serves a fakeKitsune with a running virtual machine and two production ones.
+func newConfirmKitsune(t *testing.T) *libkitsune.KitsuneClient {
+	t.Helper()
+
+	k := newFakeKitsune()
+	k.addImage("11111111-0000-0000-0000-000000000001", map[string]string{"name": "web-root"})
+	k.addImage("11111111-0000-0000-0000-000000000002", map[string]string{})
+	k.addVm("22222222-0000-0000-0000-000000000001", true, map[string]string{"name": "web"}, "11111111-0000-0000-0000-000000000001")
+	k.addVm("22222222-0000-0000-0000-000000000002", false, map[string]string{"name": "db", "env": "prod"})
+	k.addVm("22222222-0000-0000-0000-000000000003", false, map[string]string{"env": "prod"})
+	return k.serve(t)
+}
+
+func TestConfirm(t *testing.T) {
+	client := newConfirmKitsune(t)
+	web := &confirmation{verb: "delete", kind: KindVirtualMachine, ids: []*v1.UUID{{Value: "22222222-0000-0000-0000-000000000001"}}}
+	db := &confirmation{verb: "delete", kind: KindVirtualMachine, ids: []*v1.UUID{{Value: "22222222-0000-0000-0000-000000000002"}}}
+	unnamed := &confirmation{verb: "delete", kind: KindVirtualMachine, ids: []*v1.UUID{{Value: "22222222-0000-0000-0000-000000000003"}}}
+	root := &confirmation{verb: "delete", kind: KindImage, ids: []*v1.UUID{{Value: "11111111-0000-0000-0000-000000000001"}}}
+
+	tests := []struct {
+		name     string
+		c        *confirmation
+		terminal bool
+		input    string
+		args     []string
+		want     error
+		wantOut  []string
+	}{
+		{name: "not a terminal", c: web, input: "y\n", want: ConfirmationRequired},
+		{name: "not a terminal with yes", c: web, args: []string{"delete", "--yes"}},
+		{name: "not a terminal with dry run", c: web, args: []string{"--dry-run", "delete"}},
+		{
+			name:     "accepted",
+			c:        web,
+			terminal: true,
+			input:    "y\n",
+			wantOut: []string{
+				"You are about to delete 1 virtual machine:",
+				"web (22222222-0000-0000-0000-000000000001), Running, images: web-root (11111111-0000-0000-0000-000000000001)",
+				"Continue? [y/N]: ",
+			},
+		},
+		{name: "declined", c: web, terminal: true, input: "n\n", want: ConfirmationDeclined},
+		{name: "no answer", c: web, terminal: true, want: ConfirmationDeclined},
+		{
+			name:     "image",
+			c:        root,
+			terminal: true,
+			input:    "yes\n",
+			wantOut:  []string{"web-root (11111111-0000-0000-0000-000000000001), attached to: web (22222222-0000-0000-0000-000000000001)"},
+		},
+		{
+			name:     "production name typed",
+			c:        db,
+			terminal: true,
+			input:    "db\n",
+			wantOut:  []string{"db (22222222-0000-0000-0000-000000000002), Stopped, no images", `type "db" to confirm`},
+		},
+		{name: "production confirmed with yes", c: db, terminal: true, input: "y\n", want: ConfirmationDeclined},
+		{
+			name:     "production without a name",
+			c:        unnamed,
+			terminal: true,
+			input:    "22222222-0000-0000-0000-000000000003\n",
+			wantOut:  []string{`type "22222222-0000-0000-0000-000000000003" to confirm`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			if args == nil {
+				args = []string{"delete"}
+			}
+
+			out, err := runConfirm(t, client, test.c, test.terminal, test.input, args...)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("confirm() = %v, want %v", err, test.want)
+			}
+			for _, want := range test.wantOut {
+				if !strings.Contains(out, want) {
+					t.Errorf("confirm() printed %q, want it to contain %q", out, want)
+				}
+			}
+			if strings.Contains(out, "[production]") && strings.Contains(out, "Continue?") {
+				t.Errorf("confirm() printed %q, production targets must not be confirmed with y", out)
+			}
+		})
+	}
+}
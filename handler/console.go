@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/peterh/liner"
 	"github.com/urfave/cli/v2"
 	"os"
@@ -83,7 +84,7 @@ func Console(cCtx *cli.Context) error {
 				continue
 			}
 
-			newArgs := append([]string{file, "--target", cCtx.String("target")}, args...)
+			newArgs := append(append([]string{file}, globalArgs(cCtx)...), args...)
 			if err := cCtx.App.RunContext(context.WithValue(cCtx.Context, ConsoleCtxKey, args), newArgs); err != nil {
 				PrintError("%s\n", err)
 			}
@@ -113,3 +114,15 @@ func splitBySpace(s string) []string {
 		return currentQuoteChar == '\000' && r == ' '
 	})
 }
+
+// globalArgs reconstructs the global flags that were set when launching the console,
+// so that they apply to every command issued in it.
+func globalArgs(cCtx *cli.Context) (args []string) {
+	for _, flag := range cCtx.App.Flags {
+		name := flag.Names()[0]
+		if cCtx.IsSet(name) {
+			args = append(args, fmt.Sprintf("--%s=%v", name, cCtx.Value(name)))
+		}
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"path/filepath"
+	"time"
+)
+
+// MissingContextName is an error about a context command being invoked without a context name.
+var MissingContextName = errors.New("missing context name")
+
+// NoContextSelected is an error about no context being selected.
+var NoContextSelected = errors.New("no context selected, use --context or 'kitsh context use'")
+
+// newContextOutput creates an Output for contexts.
+func newContextOutput() *Output {
+	return NewOutput(KindContext, "Current", "Name", "Target", "TLS", "Auth", "Output", "Timeout")
+}
+
+// addContextRow adds the supplied context to the supplied Output, marking it if it is the current context.
+func addContextRow(out *Output, ctx *ConfigContext, current bool) {
+	marker := ""
+	if current {
+		marker = "*"
+	}
+
+	tls := ctx.TLS != nil && ctx.TLS.active()
+	auth := ""
+	if ctx.Auth != nil {
+		switch {
+		case ctx.Auth.Token != "":
+			auth = "token"
+		case ctx.Auth.TokenFile != "":
+			auth = "token-file"
+		case ctx.Auth.CredentialHelper != "":
+			auth = "credential-helper"
+		}
+	}
+
+	redacted := *ctx
+	if ctx.Auth != nil {
+		redacted.Auth = ctx.Auth.redacted()
+	}
+	out.Add(&redacted, marker, ctx.Name, ctx.Target, tls, auth, ctx.Output, ctx.Timeout)
+}
+
+// ListContexts is a handler for the "context list" command.
+func ListContexts(cCtx *cli.Context) error {
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+
+	out := newContextOutput()
+	for _, ctx := range config.Contexts {
+		addContextRow(out, ctx, ctx.Name == config.CurrentContext)
+	}
+
+	return out.Render(cCtx)
+}
+
+// UseContext is a handler for the "context use" command.
+func UseContext(cCtx *cli.Context) error {
+	name := cCtx.Args().First()
+	if name == "" {
+		return MissingContextName
+	}
+
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	if config.Find(name) == nil {
+		return fmt.Errorf("%w: %s", UnknownContext, name)
+	}
+
+	config.CurrentContext = name
+	return saveConfig(cCtx, config)
+}
+
+// AddContext is a handler for the "context add" command.
+func AddContext(cCtx *cli.Context) error {
+	name := cCtx.String("name")
+
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	if config.Find(name) != nil {
+		return fmt.Errorf("%w: %s", ContextExists, name)
+	}
+
+	if output := cCtx.String("default-output"); output != "" {
+		if _, _, err := parseOutputFormat(output); err != nil {
+			return err
+		}
+	}
+	if timeout := cCtx.String("timeout"); timeout != "" {
+		if _, err := time.ParseDuration(timeout); err != nil {
+			return err
+		}
+	}
+
+	ctx := &ConfigContext{
+		Name:    name,
+		Target:  cCtx.String("target"),
+		Output:  cCtx.String("default-output"),
+		Timeout: cCtx.String("timeout"),
+	}
+	tls := &TLSConfig{
+		Enabled:            cCtx.Bool("tls"),
+		CAFile:             absPath(cCtx.String("ca-file")),
+		CertFile:           absPath(cCtx.String("cert")),
+		KeyFile:            absPath(cCtx.String("key")),
+		ServerName:         cCtx.String("server-name"),
+		InsecureSkipVerify: cCtx.Bool("insecure-skip-verify"),
+	}
+	if tls.active() {
+		tls.Enabled = true
+		ctx.TLS = tls
+	}
+
+	auth := &AuthConfig{
+		Token:            cCtx.String("token"),
+		TokenFile:        absPath(cCtx.String("token-file")),
+		CredentialHelper: cCtx.String("credential-helper"),
+		AllowInsecure:    cCtx.Bool("allow-insecure-token"),
+	}
+	if auth.active() {
+		ctx.Auth = auth
+	}
+
+	config.Contexts = append(config.Contexts, ctx)
+	if cCtx.Bool("use") || config.CurrentContext == "" {
+		config.CurrentContext = name
+	}
+
+	return saveConfig(cCtx, config)
+}
+
+// RemoveContext is a handler for the "context remove" command.
+func RemoveContext(cCtx *cli.Context) error {
+	name := cCtx.Args().First()
+	if name == "" {
+		return MissingContextName
+	}
+
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+
+	for i, ctx := range config.Contexts {
+		if ctx.Name != name {
+			continue
+		}
+
+		config.Contexts = append(config.Contexts[:i], config.Contexts[i+1:]...)
+		if config.CurrentContext == name {
+			config.CurrentContext = ""
+		}
+		return saveConfig(cCtx, config)
+	}
+
+	return fmt.Errorf("%w: %s", UnknownContext, name)
+}
+
+// ShowContext is a handler for the "context show" command.
+func ShowContext(cCtx *cli.Context) error {
+	config, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+
+	name := cCtx.Args().First()
+	if name == "" {
+		name = cCtx.String("context")
+	}
+	if name == "" {
+		name = config.CurrentContext
+	}
+	if name == "" {
+		return NoContextSelected
+	}
+
+	ctx := config.Find(name)
+	if ctx == nil {
+		return fmt.Errorf("%w: %s", UnknownContext, name)
+	}
+
+	out := newContextOutput()
+	addContextRow(out, ctx, ctx.Name == config.CurrentContext)
+
+	return out.Render(cCtx)
+}
+
+// absPath makes the supplied path absolute, so that contexts work regardless of the working directory.
+// Empty paths are left untouched.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
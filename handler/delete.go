@@ -0,0 +1,325 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"strings"
+)
+
+// attachments maps virtual machines to the images attached to them and back, keyed by UUID.
+type attachments struct {
+	vmImages map[string][]*v1.UUID
+	imageVms map[string][]*v1.UUID
+}
+
+// fetchAttachments fetches the images attached to every virtual machine with bounded concurrency.
+func fetchAttachments(ctx context.Context, client *libkitsune.KitsuneClient) (*attachments, error) {
+	stream, err := client.VmRegistry.GetVirtualMachines(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*v1.VirtualMachine
+	if err := forEachVms(stream, func(vm *v1.VirtualMachine) error {
+		vms = append(vms, vm)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	vmImages := make([][]*v1.UUID, len(vms))
+	tasks := make([]func() error, len(vms))
+	for i, vm := range vms {
+		i, vm := i, vm
+		tasks[i] = func() (err error) {
+			vmImages[i], err = fetchAttachedImageIds(ctx, client.VmRegistry, vm.GetId())
+			if isNotFound(err) {
+				return nil // deleted in the meantime
+			}
+			return
+		}
+	}
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return nil, err
+	}
+
+	return newAttachments(vms, vmImages), nil
+}
+
+// newAttachments maps the supplied virtual machines to the supplied images attached to them, by index, and back.
+func newAttachments(vms []*v1.VirtualMachine, vmImages [][]*v1.UUID) *attachments {
+	att := &attachments{vmImages: make(map[string][]*v1.UUID), imageVms: make(map[string][]*v1.UUID)}
+	for i, vm := range vms {
+		for _, imageId := range vmImages[i] {
+			att.vmImages[vm.GetId().GetValue()] = append(att.vmImages[vm.GetId().GetValue()], imageId)
+			att.imageVms[imageId.GetValue()] = append(att.imageVms[imageId.GetValue()], vm.GetId())
+		}
+	}
+
+	return att
+}
+
+// remove removes the supplied virtual machine and its attachments.
+func (a *attachments) remove(vm *v1.UUID) {
+	for _, imageId := range a.vmImages[vm.GetValue()] {
+		var remaining []*v1.UUID
+		for _, other := range a.imageVms[imageId.GetValue()] {
+			if other.GetValue() != vm.GetValue() {
+				remaining = append(remaining, other)
+			}
+		}
+		a.imageVms[imageId.GetValue()] = remaining
+	}
+	delete(a.vmImages, vm.GetValue())
+}
+
+// cascade is the planned removal of a virtual machine by "vm delete --cascade".
+type cascade struct {
+	vm    *v1.UUID
+	alive bool
+	// detach are all images attached to the virtual machine, delete are those not used by any other virtual machine.
+	detach []*v1.UUID
+	delete []*v1.UUID
+}
+
+// planCascades plans the removal of the supplied virtual machines, an image shared only by them
+// is deleted along with the last one.
+func planCascades(ctx context.Context, client *libkitsune.KitsuneClient, ids []*v1.UUID) ([]*cascade, error) {
+	att, err := fetchAttachments(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	cascades := make([]*cascade, len(ids))
+	for i, id := range ids {
+		c := &cascade{vm: id, detach: att.vmImages[id.GetValue()]}
+		att.remove(id)
+		for _, imageId := range c.detach {
+			if len(att.imageVms[imageId.GetValue()]) == 0 {
+				c.delete = append(c.delete, imageId)
+			}
+		}
+		cascades[i] = c
+	}
+
+	tasks := make([]func() error, len(cascades))
+	for i, c := range cascades {
+		c := c
+		tasks[i] = func() (err error) {
+			c.alive, err = isAlive(ctx, client, c.vm)
+			return
+		}
+	}
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return nil, err
+	}
+
+	return cascades, nil
+}
+
+// run powers off the virtual machine and waits until it stopped, detaches its images, deletes it and then the images
+// not used elsewhere. Errors list the steps done before, as the cascade isn't rolled back.
+func (c *cascade) run(ctx context.Context, client *libkitsune.KitsuneClient, w *powerWait) error {
+	var done []string
+	fail := func(err error) error {
+		if len(done) == 0 {
+			return err
+		}
+		return fmt.Errorf("%w (already done: %s)", err, strings.Join(done, ", "))
+	}
+
+	if c.alive {
+		if err := sendPowerAction(ctx, client, c.vm, v1.PowerAction_POWERDOWN); err != nil {
+			return fail(fmt.Errorf("failed to power off: %w", err))
+		}
+		// kitsune may refuse to detach images from virtual machines still running
+		if err := w.until(ctx, client, c.vm, false, w.timeout); err != nil {
+			return fail(fmt.Errorf("failed to power off: %w", err))
+		}
+		done = append(done, "powered off")
+	}
+	for _, imageId := range c.detach {
+		if err := attachImage(ctx, client, OpDetach, c.vm, imageId); err != nil {
+			return fail(fmt.Errorf("failed to detach image %s: %w", imageId.GetValue(), err))
+		}
+		done = append(done, "detached image "+imageId.GetValue())
+	}
+	if err := deleteVirtualMachine(ctx, client, c.vm); err != nil {
+		return fail(err)
+	}
+	done = append(done, "deleted the virtual machine")
+	for _, imageId := range c.delete {
+		err := deleteImage(ctx, client, imageId)
+		if isNotFound(err) {
+			continue // deleted in the meantime
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to delete image %s: %w", imageId.GetValue(), err))
+		}
+		done = append(done, "deleted image "+imageId.GetValue())
+	}
+
+	return nil
+}
+
+// printCascades prints a summary of what the supplied cascades remove.
+func printCascades(cascades []*cascade) {
+	for _, c := range cascades {
+		_, _ = ErrorColor.Printf("- delete virtual machine %s\n", c.vm.GetValue())
+		for _, line := range c.lines() {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+}
+
+// lines describes the steps of the cascade besides deleting the virtual machine, one colored line per step.
+func (c *cascade) lines() []string {
+	var lines []string
+	if c.alive {
+		lines = append(lines, WarningColor.Sprint("~ power off (running)"))
+	}
+	for _, imageId := range c.detach {
+		if containsId(c.delete, imageId) {
+			lines = append(lines, ErrorColor.Sprintf("- delete image %s", imageId.GetValue()))
+		} else {
+			lines = append(lines, WarningColor.Sprintf("~ detach image %s (used by other virtual machines)", imageId.GetValue()))
+		}
+	}
+	return lines
+}
+
+// refuseAttached returns a FailedPrecondition error if the supplied image is attached to any virtual machine,
+// ending with the supplied hint on how to proceed.
+func refuseAttached(att *attachments, id *v1.UUID, hint string) error {
+	if vms := att.imageVms[id.GetValue()]; len(vms) > 0 {
+		return &KitshError{
+			Code: codes.FailedPrecondition,
+			Msg:  fmt.Sprintf("image %s is attached to virtual machines %s, %s", id.GetValue(), joinIds(vms), hint),
+		}
+	}
+	return nil
+}
+
+// detachAll detaches the supplied image from all virtual machines using it.
+func detachAll(ctx context.Context, client *libkitsune.KitsuneClient, att *attachments, id *v1.UUID) error {
+	for _, vm := range att.imageVms[id.GetValue()] {
+		err := attachImage(ctx, client, OpDetach, vm, id)
+		if isNotFound(err) {
+			continue // deleted in the meantime
+		}
+		if err != nil {
+			return fmt.Errorf("failed to detach from virtual machine %s: %w", vm.GetValue(), err)
+		}
+	}
+
+	return nil
+}
+
+// deleteVirtualMachinesCascade is the "vm delete --cascade" part of DeleteVirtualMachine.
+func deleteVirtualMachinesCascade(cCtx *cli.Context, client *libkitsune.KitsuneClient, ids []*v1.UUID) error {
+	w, err := newPowerWait(cCtx)
+	if err != nil {
+		return err
+	}
+
+	cascades, err := planCascades(cCtx.Context, client, ids)
+	if err != nil {
+		return err
+	}
+
+	var deleted, detached []*v1.UUID
+	for _, c := range cascades {
+		for _, imageId := range c.detach {
+			if containsId(c.delete, imageId) {
+				deleted = append(deleted, imageId)
+			} else {
+				detached = append(detached, imageId)
+			}
+		}
+	}
+	err = runConcurrently(
+		func() error {
+			return checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, "delete", ids...)
+		},
+		func() error {
+			return checkProtected(cCtx.Context, client.ImageRegistry, KindImage, "delete", deleted...)
+		},
+		func() error {
+			return checkProtected(cCtx.Context, client.ImageRegistry, KindImage, "detach", detached...)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	byId := make(map[string]*cascade, len(cascades))
+	for _, c := range cascades {
+		byId[c.vm.GetValue()] = c
+	}
+	err = confirm(cCtx, client, &confirmation{
+		verb: "delete",
+		kind: KindVirtualMachine,
+		ids:  ids,
+		details: func(id *v1.UUID) []string {
+			return byId[id.GetValue()].lines()
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Bool("yes") && IsPrettyOutput(cCtx) {
+		printCascades(cascades) // otherwise already shown by the confirmation
+	}
+
+	for _, c := range cascades {
+		if err := c.run(cCtx.Context, client, w); err != nil {
+			if len(cascades) > 1 {
+				return fmt.Errorf("%s: %w", c.vm.GetValue(), err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joinIds joins the values of the supplied UUIDs with commas.
+func joinIds(ids []*v1.UUID) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = id.GetValue()
+	}
+	return strings.Join(values, ", ")
+}
+
+// isAlive checks whether the supplied virtual machine is running.
+func isAlive(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID) (bool, error) {
+	res, err := client.VmRegistry.IsAlive(ctx, &v1.IsAliveRequest{Id: id})
+	if err != nil {
+		return false, err
+	}
+	if res.GetError() != nil {
+		return false, formatError(res.GetError())
+	}
+
+	return res.GetAlive(), nil
+}
+
+// sendPowerAction sends the supplied power action to the supplied virtual machine.
+func sendPowerAction(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID, action v1.PowerAction) error {
+	res, err := client.VmRegistry.SendPowerAction(ctx, &v1.SendPowerActionRequest{Machine: id, Action: action})
+	if err != nil {
+		return err
+	}
+	if res.GetError() != nil {
+		return formatError(res.GetError())
+	}
+
+	return nil
+}
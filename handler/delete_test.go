@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uuidValues gets the values of the supplied UUIDs.
+func uuidValues(ids []*v1.UUID) []string {
+	var values []string
+	for _, id := range ids {
+		values = append(values, id.GetValue())
+	}
+	return values
+}
+
+func TestAttachmentsRemove(t *testing.T) {
+	uuid := func(value string) *v1.UUID { return &v1.UUID{Value: value} }
+	att := newAttachments(
+		[]*v1.VirtualMachine{{Id: uuid("vm-a")}, {Id: uuid("vm-b")}, {Id: uuid("vm-c")}},
+		[][]*v1.UUID{{uuid("root-a"), uuid("shared")}, {uuid("shared")}, nil},
+	)
+
+	att.remove(uuid("vm-a"))
+	if images := att.vmImages["vm-a"]; images != nil {
+		t.Errorf("vm-a images = %q, want none", uuidValues(images))
+	}
+	if vms := att.imageVms["root-a"]; len(vms) != 0 {
+		t.Errorf("root-a virtual machines = %q, want none", uuidValues(vms))
+	}
+	if vms := uuidValues(att.imageVms["shared"]); !reflect.DeepEqual(vms, []string{"vm-b"}) {
+		t.Errorf("shared virtual machines = %q, want [vm-b]", vms)
+	}
+
+	// removing unknown or unattached virtual machines changes nothing
+	att.remove(uuid("vm-c"))
+	att.remove(uuid("vm-unknown"))
+	if vms := uuidValues(att.imageVms["shared"]); !reflect.DeepEqual(vms, []string{"vm-b"}) {
+		t.Errorf("shared virtual machines = %q, want [vm-b]", vms)
+	}
+	if images := uuidValues(att.vmImages["vm-b"]); !reflect.DeepEqual(images, []string{"shared"}) {
+		t.Errorf("vm-b images = %q, want [shared]", images)
+	}
+}
+
+func TestPlanCascades(t *testing.T) {
+	k := newFakeKitsune()
+	k.addVm("vm-a", true, nil, "root-a", "shared")
+	k.addVm("vm-b", false, nil, "shared", "data-b")
+	k.addVm("vm-c", false, nil, "shared")
+	k.addVm("vm-gone", false, nil, "shared")
+	k.vanished["vm-gone"] = true // its attachments don't count
+	client := k.serve(t)
+
+	tests := []struct {
+		name string
+		vms  []string
+		// want are the cascades as "vm alive detach... / delete..."
+		want []string
+	}{
+		{"running", []string{"vm-a"}, []string{"vm-a true root-a,shared / root-a"}},
+		{"shared with others", []string{"vm-a", "vm-b"}, []string{"vm-a true root-a,shared / root-a", "vm-b false shared,data-b / data-b"}},
+		{"shared with deleted only", []string{"vm-a", "vm-b", "vm-c"}, []string{
+			"vm-a true root-a,shared / root-a",
+			"vm-b false shared,data-b / data-b",
+			"vm-c false shared / shared",
+		}},
+		{"last one first", []string{"vm-c", "vm-b", "vm-a"}, []string{
+			"vm-c false shared / ",
+			"vm-b false shared,data-b / data-b",
+			"vm-a true root-a,shared / root-a,shared",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ids []*v1.UUID
+			for _, vm := range test.vms {
+				ids = append(ids, &v1.UUID{Value: vm})
+			}
+
+			cascades, err := planCascades(context.Background(), client, ids)
+			if err != nil {
+				t.Fatalf("planCascades() failed: %v", err)
+			}
+
+			var got []string
+			for _, c := range cascades {
+				got = append(got, fmt.Sprintf(
+					"%s %t %s / %s",
+					c.vm.GetValue(), c.alive, strings.Join(uuidValues(c.detach), ","), strings.Join(uuidValues(c.delete), ","),
+				))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("planCascades() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCascadeRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		alive     bool
+		polls     int
+		vanished  bool
+		want      []string
+		wantErr   error
+		wantDone  string
+		wantNoErr bool
+	}{
+		{
+			name:  "waits until stopped before detaching",
+			alive: true,
+			polls: 3,
+			want: []string{
+				"SendPowerAction vm-a POWERDOWN",
+				"DetachImage vm-a root-a",
+				"DetachImage vm-a shared",
+				"DeleteVirtualMachine vm-a",
+				"DeleteImage root-a",
+			},
+			wantNoErr: true,
+		},
+		{
+			name:    "never stops",
+			alive:   true,
+			polls:   -1,
+			want:    []string{"SendPowerAction vm-a POWERDOWN"},
+			wantErr: WaitTimedOut,
+		},
+		{
+			name:     "fails midway",
+			vanished: true,
+			want:     []string{"DetachImage vm-a root-a", "DetachImage vm-a shared"},
+			wantDone: "(already done: detached image root-a, detached image shared)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newFakeKitsune()
+			k.powerdownPolls = test.polls
+			k.addVm("vm-a", test.alive, nil, "root-a", "shared")
+			k.addVm("vm-b", false, nil, "shared")
+			k.addImage("root-a", nil)
+			k.addImage("shared", nil)
+			client := k.serve(t)
+
+			cascades, err := planCascades(context.Background(), client, []*v1.UUID{{Value: "vm-a"}})
+			if err != nil {
+				t.Fatalf("planCascades() failed: %v", err)
+			}
+			k.mu.Lock()
+			k.vanished["vm-a"] = test.vanished
+			k.mu.Unlock()
+
+			w := &powerWait{interval: time.Millisecond, timeout: 50 * time.Millisecond}
+			err = cascades[0].run(context.Background(), client, w)
+			switch {
+			case test.wantNoErr && err != nil:
+				t.Fatalf("run() failed: %v", err)
+			case test.wantErr != nil && !errors.Is(err, test.wantErr):
+				t.Errorf("run() error = %v, want %v", err, test.wantErr)
+			case test.wantDone != "" && (err == nil || !strings.HasSuffix(err.Error(), test.wantDone)):
+				t.Errorf("run() error = %v, want it to end with %q", err, test.wantDone)
+			}
+
+			if !reflect.DeepEqual(k.calls, test.want) {
+				t.Errorf("calls = %q, want %q", k.calls, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InvalidConcurrency is an error about an invalid number of concurrent requests (must be positive).
+var InvalidConcurrency = errors.New("invalid concurrency")
+
+// DescribeVirtualMachine is a handler for the "vm describe" command.
+func DescribeVirtualMachine(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	vmId, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
+	if err != nil {
+		return err
+	}
+
+	desc := VirtualMachineDescription{}
+
+	err = runConcurrently(
+		func() (err error) {
+			desc.Machine, err = findVirtualMachine(cCtx.Context, client.VmRegistry, vmId)
+			return
+		},
+		func() error {
+			res, err := client.VmRegistry.IsAlive(cCtx.Context, &v1.IsAliveRequest{Id: vmId})
+			if err != nil {
+				return err
+			}
+			if res.GetError() != nil {
+				return formatError(res.GetError())
+			}
+
+			desc.Alive = res.GetAlive()
+			return nil
+		},
+		func() (err error) {
+			desc.Images, err = fetchAttachedImages(cCtx.Context, client, vmId)
+			return
+		},
+		func() (err error) {
+			desc.Metadata, err = fetchMetadata(cCtx.Context, client.VmRegistry, vmId)
+			return
+		},
+		func() error {
+			res, err := client.VmRegistry.GetVNCServers(cCtx.Context, &v1.GetVNCServersRequest{Id: vmId})
+			if err != nil {
+				return err
+			}
+			if res.GetError() != nil {
+				return formatError(res.GetError())
+			}
+
+			desc.VNCServers = res.GetServers()
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	out := NewOutput(KindVirtualMachineDescription, "Field", "Value")
+	out.AddItem(desc)
+	out.AddRow("ID", desc.Machine.GetId().GetValue())
+	out.AddRow("Architecture", desc.Machine.GetArch())
+	out.AddRow("Memory size", desc.Machine.GetMemorySize())
+	out.AddRow("Status", formatStatus(desc.Alive))
+	for _, image := range desc.Images {
+		out.AddRow("Image", formatImage(image))
+	}
+	for _, key := range sortedKeys(desc.Metadata) {
+		out.AddRow("Metadata", key+"="+desc.Metadata[key])
+	}
+	for _, server := range desc.VNCServers {
+		out.AddRow("VNC server", formatVNCServer(server))
+	}
+
+	return out.Render(cCtx)
+}
+
+// DescribeImage is a handler for the "image describe" command.
+func DescribeImage(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	workers := cCtx.Int("concurrency")
+	if workers <= 0 {
+		return InvalidConcurrency
+	}
+
+	imageId, err := newImageResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
+	if err != nil {
+		return err
+	}
+
+	desc := ImageDescription{}
+
+	err = runConcurrently(
+		func() (err error) {
+			desc.Image, err = findImage(cCtx.Context, client.ImageRegistry, imageId)
+			return
+		},
+		func() (err error) {
+			desc.Metadata, err = fetchMetadata(cCtx.Context, client.ImageRegistry, imageId)
+			return
+		},
+		func() (err error) {
+			desc.AttachedTo, err = findAttachingVms(cCtx.Context, client, imageId, workers)
+			return
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	out := NewOutput(KindImageDescription, "Field", "Value")
+	out.AddItem(desc)
+	out.AddRow("ID", desc.Image.GetId().GetValue())
+	out.AddRow("Format", desc.Image.GetFormat().String())
+	out.AddRow("Size", desc.Image.GetSize())
+	out.AddRow("Read-only", desc.Image.GetReadOnly())
+	out.AddRow("Media type", desc.Image.GetMediaType().String())
+	for _, key := range sortedKeys(desc.Metadata) {
+		out.AddRow("Metadata", key+"="+desc.Metadata[key])
+	}
+	for _, vmId := range desc.AttachedTo {
+		out.AddRow("Attached to", vmId.GetValue())
+	}
+
+	return out.Render(cCtx)
+}
+
+// findAttachingVms finds the virtual machines the supplied image is attached to, sorted by their ID.
+// The attached images of up to the supplied number of virtual machines are queried concurrently,
+// while the virtual machines are still being received.
+func findAttachingVms(ctx context.Context, client *libkitsune.KitsuneClient, image *v1.UUID, workers int) ([]*v1.UUID, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	vms, err := client.VmRegistry.GetVirtualMachines(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu       sync.Mutex
+		attached = make([]*v1.UUID, 0)
+		firstErr error
+	)
+
+	ids := make(chan *v1.UUID)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for id := range ids {
+				images, err := fetchAttachedImageIds(ctx, client.VmRegistry, id)
+				if isNotFound(err) {
+					continue // deleted in the meantime
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else if containsId(images, image) {
+					attached = append(attached, id)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = forEachVms(vms, func(vm *v1.VirtualMachine) error {
+		select {
+		case ids <- vm.GetId():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(ids)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(attached, func(i, j int) bool {
+		return attached[i].GetValue() < attached[j].GetValue()
+	})
+	return attached, nil
+}
+
+// fetchAttachedImageIds gets the IDs of the images attached to the supplied virtual machine.
+func fetchAttachedImageIds(ctx context.Context, registry v1.VirtualMachineRegistryServiceClient, id *v1.UUID) ([]*v1.UUID, error) {
+	res, err := registry.GetAttachedImages(ctx, &v1.GetAttachedImagesRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	if res.GetError() != nil {
+		return nil, formatError(res.GetError())
+	}
+
+	return res.GetImages(), nil
+}
+
+// containsId checks whether the supplied IDs contain the supplied ID.
+func containsId(ids []*v1.UUID, id *v1.UUID) bool {
+	for _, other := range ids {
+		if other.GetValue() == id.GetValue() {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchAttachedImages gets the images attached to the supplied virtual machine, resolving them concurrently.
+// Images which vanished in the meantime are only reported by their ID.
+func fetchAttachedImages(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID) ([]*v1.Image, error) {
+	imageIds, err := fetchAttachedImageIds(ctx, client.VmRegistry, id)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*v1.Image, len(imageIds))
+	tasks := make([]func() error, len(images))
+	for i, imageId := range imageIds {
+		i, imageId := i, imageId
+		tasks[i] = func() error {
+			image, err := findImage(ctx, client.ImageRegistry, imageId)
+			if isNotFound(err) {
+				image, err = &v1.Image{Id: imageId}, nil
+			}
+
+			images[i] = image
+			return err
+		}
+	}
+
+	if err := runConcurrently(tasks...); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// formatImage formats an image to a compact, readable summary.
+func formatImage(image *v1.Image) string {
+	attrs := []string{image.GetFormat().String(), fmt.Sprintf("%d bytes", image.GetSize()), image.GetMediaType().String()}
+	if image.GetReadOnly() {
+		attrs = append(attrs, "read-only")
+	}
+
+	return fmt.Sprintf("%s (%s)", image.GetId().GetValue(), strings.Join(attrs, ", "))
+}
+
+// formatVNCServer formats a VNC server to a compact, readable summary of its display and sockets.
+func formatVNCServer(server *v1.VNCServer) string {
+	sockets := make([]string, 0, len(server.GetSockets()))
+	for _, sock := range server.GetSockets() {
+		socket := fmt.Sprintf("%d/%s", sock.GetPort(), sock.GetFamily())
+		if sock.GetIsWebSocket() {
+			socket += " (websocket)"
+		}
+		sockets = append(sockets, socket)
+	}
+
+	if server.Display != nil {
+		return fmt.Sprintf("display %s: %s", server.GetDisplay(), strings.Join(sockets, ", "))
+	}
+	return strings.Join(sockets, ", ")
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindAttachingVms(t *testing.T) {
+	const image = "11111111-0000-0000-0000-000000000000"
+
+	// every third virtual machine uses the image, every fifth one is deleted while scanning
+	k := newFakeKitsune()
+	var want []string
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("22222222-0000-0000-0000-%012d", 29-i) // listed in descending order
+		images := []string{"33333333-0000-0000-0000-000000000000"}
+		if i%3 == 0 {
+			images = append(images, image)
+		}
+		k.addVm(id, false, nil, images...)
+
+		if i%5 == 0 {
+			k.vanished[id] = true
+		} else if i%3 == 0 {
+			want = append([]string{id}, want...)
+		}
+	}
+	client := k.serve(t)
+
+	for _, workers := range []int{1, 4, 64} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			vms, err := findAttachingVms(context.Background(), client, &v1.UUID{Value: image}, workers)
+			if err != nil {
+				t.Fatalf("findAttachingVms() failed: %v", err)
+			}
+			if got := uuidValues(vms); !reflect.DeepEqual(got, want) {
+				t.Errorf("findAttachingVms() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("not attached", func(t *testing.T) {
+		vms, err := findAttachingVms(context.Background(), client, &v1.UUID{Value: "44444444-0000-0000-0000-000000000000"}, 4)
+		if err != nil {
+			t.Fatalf("findAttachingVms() failed: %v", err)
+		}
+		if vms == nil || len(vms) != 0 {
+			t.Errorf("findAttachingVms() = %q, want an empty list", uuidValues(vms))
+		}
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		k.mu.Lock()
+		k.broken["22222222-0000-0000-0000-000000000011"] = true
+		k.mu.Unlock()
+		t.Cleanup(func() {
+			k.mu.Lock()
+			delete(k.broken, "22222222-0000-0000-0000-000000000011")
+			k.mu.Unlock()
+		})
+
+		_, err := findAttachingVms(context.Background(), client, &v1.UUID{Value: image}, 4)
+		if err == nil || !strings.Contains(err.Error(), "is broken") {
+			t.Errorf("findAttachingVms() = %v, want the error of the broken virtual machine", err)
+		}
+	})
+}
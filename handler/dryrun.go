@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"path"
+	"sync/atomic"
+)
+
+// dryRunUnaryInterceptor produces an interceptor which prints the requests of calls modifying state to the supplied
+// writer (stderr, stdout is left to the output of the command) as protojson instead of sending them, calls only
+// reading state are sent as usual. Created virtual machines and images get placeholder UUIDs, so that subsequent
+// requests can reference them.
+func dryRunUnaryInterceptor(w io.Writer) grpc.UnaryClientInterceptor {
+	var created uint64
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if idempotent(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(req.(proto.Message))
+		if err != nil {
+			return err
+		}
+		// unpopulated fields are emitted to show zero enum values like POWERON, protojson randomizes whitespace
+		indented := &bytes.Buffer{}
+		if err := json.Indent(indented, data, "", "  "); err != nil {
+			return err
+		}
+
+		_, _ = WarningColor.Fprintf(w, "Dry run, not sending %s:\n", path.Base(method))
+		_, _ = fmt.Fprintln(w, indented.String())
+
+		placeholder := func() *v1.UUID {
+			return &v1.UUID{Value: fmt.Sprintf("00000000-0000-0000-0000-%012d", atomic.AddUint64(&created, 1))}
+		}
+		switch res := reply.(type) {
+		case *v1.CreateImageResponse:
+			req := req.(*v1.CreateImageRequest)
+			res.ImageOrError = &v1.CreateImageResponse_Image{
+				Image: &v1.Image{Id: placeholder(), Format: req.GetFormat(), Size: req.GetSize()},
+			}
+		case *v1.CreateVirtualMachineResponse:
+			req := req.(*v1.CreateVirtualMachineRequest)
+			res.MachineOrError = &v1.CreateVirtualMachineResponse_Machine{
+				Machine: &v1.VirtualMachine{Id: placeholder(), Arch: req.GetArch(), MemorySize: req.GetMemorySize()},
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"google.golang.org/grpc"
+	"strings"
+	"testing"
+)
+
+func TestDryRunUnaryInterceptor(t *testing.T) {
+	out := &bytes.Buffer{}
+	interceptor := dryRunUnaryInterceptor(out)
+
+	invoked := 0
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked++
+		return nil
+	}
+
+	// lookups are sent
+	if err := interceptor(context.Background(), "/kitsune.proto.v1.ImageRegistryService/FindImage", &v1.FindImageRequest{}, &v1.FindImageResponse{}, nil, invoker); err != nil {
+		t.Fatalf("FindImage failed: %v", err)
+	}
+	if invoked != 1 || out.Len() != 0 {
+		t.Fatalf("FindImage invoked %d times with output %q, want it sent silently", invoked, out.String())
+	}
+
+	image := &v1.CreateImageResponse{}
+	req := &v1.CreateImageRequest{Format: v1.Image_QCOW2, Size: 1024}
+	if err := interceptor(context.Background(), "/kitsune.proto.v1.ImageRegistryService/CreateImage", req, image, nil, invoker); err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	}
+	vm := &v1.CreateVirtualMachineResponse{}
+	if err := interceptor(context.Background(), "/kitsune.proto.v1.VirtualMachineRegistryService/CreateVirtualMachine", &v1.CreateVirtualMachineRequest{Arch: v1.Architecture_X86_64, MemorySize: 512}, vm, nil, invoker); err != nil {
+		t.Fatalf("CreateVirtualMachine failed: %v", err)
+	}
+	power := &v1.SendPowerActionRequest{Machine: &v1.UUID{Value: testId}}
+	if err := interceptor(context.Background(), "/kitsune.proto.v1.VirtualMachineRegistryService/SendPowerAction", power, &v1.SendPowerActionResponse{}, nil, invoker); err != nil {
+		t.Fatalf("SendPowerAction failed: %v", err)
+	}
+	if invoked != 1 {
+		t.Errorf("calls modifying state invoked %d times, want them not sent", invoked-1)
+	}
+
+	// placeholders are numbered and keep the requested shape
+	if got := image.GetImage(); got.GetId().GetValue() != "00000000-0000-0000-0000-000000000001" || got.GetSize() != 1024 || got.GetFormat() != v1.Image_QCOW2 {
+		t.Errorf("CreateImage reply = %v, want the first placeholder", got)
+	}
+	if got := vm.GetMachine(); got.GetId().GetValue() != "00000000-0000-0000-0000-000000000002" || got.GetMemorySize() != 512 || got.GetArch() != v1.Architecture_X86_64 {
+		t.Errorf("CreateVirtualMachine reply = %v, want the second placeholder", got)
+	}
+
+	// requests are printed to the supplied writer, zero enum values included
+	for _, want := range []string{
+		"Dry run, not sending CreateImage:\n{\n  \"format\": \"QCOW2\",\n  \"size\": \"1024\"",
+		"Dry run, not sending CreateVirtualMachine:",
+		"Dry run, not sending SendPowerAction:",
+		"\"action\": \"POWERON\"",
+		"\"value\": \"" + testId + "\"",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output = %q, want it to contain %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+)
+
+// NotAnObject is an error about edited metadata which isn't a JSON object, e.g. null.
+var NotAnObject = errors.New("the metadata must be a JSON object of strings")
+
+// editHeader is prepended to files opened in the editor, comment lines are stripped before parsing.
+const editHeader = `# Edit the metadata of %s %s as a JSON object of strings and save to apply it.
+# Lines starting with '#' are ignored, an empty file aborts the edit.
+`
+
+// EditMetadataFunc produces a handler for "metadata edit" commands, resolving the "id" flag with the supplied
+// Resolver. The metadata is opened in the editor until it is valid, and written back only if it changed.
+func EditMetadataFunc(registry MetadatableRegistry, resolver *Resolver) func(cCtx *cli.Context) error {
+	return func(cCtx *cli.Context) error {
+		id, err := resolver.Resolve(cCtx.Context, cCtx.String("id"))
+		if err != nil {
+			return err
+		}
+
+		base, err := fetchMetadata(cCtx.Context, registry, id)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.MarshalIndent(base, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		header := fmt.Sprintf(editHeader, resolver.noun, id.GetValue())
+		content := header + string(body) + "\n"
+		for {
+			edited, err := editInEditor(cCtx, content)
+			if err != nil {
+				return err
+			}
+
+			body := stripComments(edited)
+			if strings.TrimSpace(body) == "" {
+				fmt.Println("Edit cancelled, no changes made.")
+				return nil
+			}
+
+			data, err := parseEditedMetadata(body, base)
+			if err != nil {
+				// reopen the edited metadata, like kubectl edit does
+				content = fmt.Sprintf("# error: %s\n", err) + header + body
+				continue
+			}
+
+			if equalMetadata(base, data) {
+				fmt.Println("Edit cancelled, no changes made.")
+				return nil
+			}
+
+			printMetadataDiff("", base, data)
+			if err := writeMetadata(cCtx.Context, registry, id, base, data); err != nil {
+				return err
+			}
+
+			PrintSuccess("Metadata of %s %s updated.\n", resolver.noun, id.GetValue())
+			return nil
+		}
+	}
+}
+
+// parseEditedMetadata parses the supplied edited metadata, which must be a JSON object
+// and must keep the protection of the supplied original metadata.
+func parseEditedMetadata(body string, base map[string]string) (map[string]string, error) {
+	var data map[string]string
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		return nil, err
+	}
+	if data == nil { // null
+		return nil, NotAnObject
+	}
+
+	if protected, ok := base[ProtectedKey]; ok && data[ProtectedKey] != protected {
+		return nil, fmt.Errorf("%s can only be changed with the protect and unprotect commands", ProtectedKey)
+	}
+
+	return data, nil
+}
+
+// editInEditor opens the supplied content in the editor selected by $KITSH_EDITOR, $VISUAL or $EDITOR
+// (in this order, falling back to vi) and returns the saved content.
+func editInEditor(cCtx *cli.Context, content string) (string, error) {
+	file, err := os.CreateTemp("", "kitsh-edit-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(content); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	editor := "vi"
+	for _, env := range []string{"KITSH_EDITOR", "VISUAL", "EDITOR"} {
+		if value := os.Getenv(env); value != "" {
+			editor = value
+			break
+		}
+	}
+
+	cmd := shellCommand(cCtx.Context, fmt.Sprintf("%s %q", editor, file.Name()))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed: %w", err)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// stripComments removes all lines starting with '#' from the supplied content.
+func stripComments(content string) string {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			buf.WriteString(line)
+		}
+	}
+
+	return buf.String()
+}
+
+// printMetadataDiff prints the keys added (+), removed (-) or changed (both) between the supplied metadata maps,
+// every line prefixed with the supplied indentation.
+func printMetadataDiff(indent string, before, after map[string]string) {
+	union := make(map[string]string, len(before)+len(after))
+	for key := range before {
+		union[key] = ""
+	}
+	for key := range after {
+		union[key] = ""
+	}
+
+	for _, key := range sortedKeys(union) {
+		old, hadOld := before[key]
+		value, hasNew := after[key]
+		if hadOld && hasNew && old == value {
+			continue
+		}
+
+		if hadOld {
+			_, _ = ErrorColor.Printf("%s- %s=%s\n", indent, key, old)
+		}
+		if hasNew {
+			PrintSuccess("%s+ %s=%s\n", indent, key, value)
+		}
+	}
+}
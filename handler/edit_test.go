@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseEditedMetadata(t *testing.T) {
+	protected := map[string]string{"env": "prod", ProtectedKey: "true"}
+
+	tests := []struct {
+		name    string
+		body    string
+		base    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"object", `{"env": "stage"}`, map[string]string{"env": "prod"}, map[string]string{"env": "stage"}, false},
+		{"empty object", `{}`, map[string]string{"env": "prod"}, map[string]string{}, false},
+		{"null", `null`, map[string]string{"env": "prod"}, nil, true},
+		{"array", `["env"]`, map[string]string{}, nil, true},
+		{"string", `"env"`, map[string]string{}, nil, true},
+		{"non-string value", `{"replicas": 2}`, map[string]string{}, nil, true},
+		{"keep protection", `{"env": "stage", "kitsh.protected": "true"}`, protected, map[string]string{"env": "stage", ProtectedKey: "true"}, false},
+		{"remove protection", `{"env": "stage"}`, protected, nil, true},
+		{"change protection", `{"env": "prod", "kitsh.protected": "false"}`, protected, nil, true},
+		{"null with protection", `null`, protected, nil, true},
+		{"add protection", `{"kitsh.protected": "true"}`, map[string]string{}, map[string]string{ProtectedKey: "true"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseEditedMetadata(test.body, test.base)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseEditedMetadata() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEditedMetadata() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseEditedMetadata() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := parseEditedMetadata("null", nil); !errors.Is(err, NotAnObject) {
+		t.Errorf("parseEditedMetadata() error = %v, want %v", err, NotAnObject)
+	}
+}
+
+func TestEditMetadataReopensInvalidEdits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test editor is a shell script")
+	}
+
+	// the editor saves the supplied edits one after another, keeping a copy of what it was opened with
+	dir := t.TempDir()
+	edits := []string{`null`, `{"env": "stage"}`, `{"env": "stage", "kitsh.protected": "true"}`}
+	for i, edit := range edits {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("edit%d", i+1)), []byte(edit), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := `n=$(cat "$0.count" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$0.count"; cp "$1" "$0.seen$n"; cp "$(dirname "$0")/edit$n" "$1"`
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KITSH_EDITOR", "sh "+editor)
+
+	registry := newMemoryRegistry(map[string]string{"env": "prod", ProtectedKey: "true"})
+	commands := []*cli.Command{
+		{
+			Name:   "edit",
+			Flags:  []cli.Flag{&cli.StringFlag{Name: "id"}},
+			Action: EditMetadataFunc(registry, newTestResolver(registry)),
+		},
+	}
+	if err := runTestApp(t, commands, "edit", "--id", testId); err != nil {
+		t.Fatalf("edit failed: %v", err)
+	}
+
+	if want := map[string]string{"env": "stage", ProtectedKey: "true"}; !reflect.DeepEqual(registry.data[testId], want) {
+		t.Errorf("metadata = %v, want %v", registry.data[testId], want)
+	}
+
+	for i, want := range []string{"# error: " + NotAnObject.Error(), "# error: " + ProtectedKey + " can only be changed"} {
+		seen, err := os.ReadFile(fmt.Sprintf("%s.seen%d", editor, i+2))
+		if err != nil {
+			t.Fatalf("editor opened %d times, want %d", i+1, len(edits))
+		}
+		if !strings.HasPrefix(string(seen), want) {
+			t.Errorf("editor reopened with %q, want it to start with %q", seen, want)
+		}
+	}
+}
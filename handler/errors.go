@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// Exit codes of kitsh, every error maps to exactly one of them.
+const (
+	// ExitError is the exit code of errors not covered by any other exit code, e.g. invalid flags or local I/O errors.
+	ExitError = 1
+	// ExitInvalidArgument is the exit code of requests rejected by kitsune as invalid.
+	ExitInvalidArgument = 2
+	// ExitNotFound is the exit code of requests referencing a virtual machine or an image that does not exist.
+	ExitNotFound = 3
+	// ExitConnection is the exit code of failures to reach kitsune, including exceeded timeouts.
+	ExitConnection = 4
+	// ExitServer is the exit code of requests that kitsune failed to process.
+	ExitServer = 5
+	// ExitUnauthenticated is the exit code of requests rejected by kitsune due to missing or insufficient credentials.
+	ExitUnauthenticated = 6
+	// ExitConflict is the exit code of updates aborted because of concurrent modifications.
+	ExitConflict = 7
+	// ExitDrift is the exit code of "kitsh plan" if kitsune doesn't match the manifests.
+	ExitDrift = 8
+	// ExitProtected is the exit code of operations refused because a virtual machine or image is protected.
+	ExitProtected = 9
+)
+
+// KitshError is an error reported by kitsune, either as a kitsune.proto.v1.Error in a response
+// or as a gRPC status of a failed call, or derived from its responses (e.g. a missing virtual machine).
+type KitshError struct {
+	// Type is the type of the kitsune.proto.v1.Error, empty for failed calls.
+	Type string
+	// Code is the gRPC status code of the failed call, or the code corresponding to Type.
+	Code codes.Code
+	// Msg is the human-readable message of the error.
+	Msg string
+}
+
+// Error formats the error like kitsune reports it.
+func (e *KitshError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("%s: %s", e.Type, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Msg)
+}
+
+// ExitCode gets the exit code of the error, it implements cli.ExitCoder.
+func (e *KitshError) ExitCode() int {
+	switch e.Code {
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return ExitInvalidArgument
+	case codes.NotFound:
+		return ExitNotFound
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return ExitConnection
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return ExitUnauthenticated
+	case codes.Aborted:
+		return ExitConflict
+	}
+	return ExitServer
+}
+
+// ErrorReport is an error as printed in machine-readable output modes,
+// Type and Code are empty for errors not reported by kitsune.
+type ErrorReport struct {
+	Type     string `json:"type"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// formatError converts a kitsune.proto.v1.Error to a KitshError.
+func formatError(e *v1.Error) error {
+	return &KitshError{Type: e.GetType(), Code: typeCode(e.GetType()), Msg: e.GetMsg()}
+}
+
+// typeCode guesses the gRPC status code corresponding to the supplied kitsune.proto.v1.Error type.
+// kitsune doesn't define a closed set of types, so they are matched loosely (e.g. "NotFound", "NoSuchElementException").
+func typeCode(errType string) codes.Code {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(errType))
+
+	switch {
+	case strings.Contains(normalized, "notfound") || strings.Contains(normalized, "nosuch"):
+		return codes.NotFound
+	case strings.Contains(normalized, "invalid") || strings.Contains(normalized, "illegal") || strings.Contains(normalized, "argument"):
+		return codes.InvalidArgument
+	case strings.Contains(normalized, "unauthenticated") || strings.Contains(normalized, "unauthorized"):
+		return codes.Unauthenticated
+	case strings.Contains(normalized, "permission") || strings.Contains(normalized, "forbidden"):
+		return codes.PermissionDenied
+	case strings.Contains(normalized, "unavailable"):
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+// asKitshError converts the supplied error to a KitshError, if it was reported by kitsune.
+func asKitshError(err error) (*KitshError, bool) {
+	var kErr *KitshError
+	if errors.As(err, &kErr) {
+		return kErr, true
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		st := grpcErr.GRPCStatus()
+		return &KitshError{Code: st.Code(), Msg: st.Message()}, true
+	}
+
+	return nil, false
+}
+
+// isNotFound checks whether the supplied error was reported by kitsune because a virtual machine or an image
+// does not exist (anymore).
+func isNotFound(err error) bool {
+	kErr, ok := asKitshError(err)
+	return ok && kErr.ExitCode() == ExitNotFound
+}
+
+// ExitCode gets the exit code of the supplied error.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitCoder cli.ExitCoder
+	if errors.As(err, &exitCoder) {
+		return exitCoder.ExitCode()
+	}
+	if kErr, ok := asKitshError(err); ok {
+		return kErr.ExitCode()
+	}
+
+	return ExitError
+}
+
+// HandleError prints the supplied error to stderr, as an ErrorReport in machine-readable output modes,
+// and returns its exit code.
+func HandleError(cCtx *cli.Context, err error) int {
+	code := ExitCode(err)
+	if IsPrettyOutput(cCtx) {
+		PrintError("%s\n", err)
+		return code
+	}
+
+	report := ErrorReport{Message: err.Error(), ExitCode: code}
+	if kErr, ok := asKitshError(err); ok {
+		report.Type, report.Code, report.Message = kErr.Type, kErr.Code.String(), kErr.Msg
+	}
+
+	data, mErr := envelope(KindError, report)
+	if mErr != nil {
+		PrintError("%s\n", err)
+		return code
+	}
+
+	_, _ = fmt.Fprintln(color.Error, string(data))
+	return code
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	kitsuneError := func(errType string) error {
+		msg := "failed"
+		return formatError(&v1.Error{Type: errType, Msg: &msg})
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"plain", errors.New("failed"), ExitError},
+		{"exit coder", cli.Exit("drift", ExitDrift), ExitDrift},
+		{"wrapped exit coder", fmt.Errorf("vm: %w", cli.Exit("drift", ExitDrift)), ExitDrift},
+		{"protected", &ProtectedError{Kind: KindImage, Id: &v1.UUID{Value: testId}, Op: "delete"}, ExitProtected},
+		{"invalid argument", status.Error(codes.InvalidArgument, "failed"), ExitInvalidArgument},
+		{"out of range", status.Error(codes.OutOfRange, "failed"), ExitInvalidArgument},
+		{"failed precondition", status.Error(codes.FailedPrecondition, "failed"), ExitInvalidArgument},
+		{"not found", status.Error(codes.NotFound, "failed"), ExitNotFound},
+		{"unavailable", status.Error(codes.Unavailable, "failed"), ExitConnection},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "failed"), ExitConnection},
+		{"canceled", status.Error(codes.Canceled, "failed"), ExitConnection},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "failed"), ExitUnauthenticated},
+		{"permission denied", status.Error(codes.PermissionDenied, "failed"), ExitUnauthenticated},
+		{"aborted", status.Error(codes.Aborted, "failed"), ExitConflict},
+		{"internal", status.Error(codes.Internal, "failed"), ExitServer},
+		{"wrapped status", fmt.Errorf("image: %w", status.Error(codes.NotFound, "failed")), ExitNotFound},
+		{"type not found", kitsuneError("NotFound"), ExitNotFound},
+		{"type no such element", kitsuneError("NoSuchElementException"), ExitNotFound},
+		{"type illegal argument", kitsuneError("IllegalArgumentException"), ExitInvalidArgument},
+		{"type invalid", kitsuneError("INVALID_FORMAT"), ExitInvalidArgument},
+		{"type unauthorized", kitsuneError("Unauthorized"), ExitUnauthenticated},
+		{"type forbidden", kitsuneError("forbidden"), ExitUnauthenticated},
+		{"type unavailable", kitsuneError("service-unavailable"), ExitConnection},
+		{"type unknown", kitsuneError("RuntimeException"), ExitServer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ExitCode(test.err); got != test.want {
+				t.Errorf("ExitCode() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	msg := "no such vm"
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("not found"), false},
+		{"status", status.Error(codes.NotFound, "failed"), true},
+		{"wrapped status", fmt.Errorf("vm: %w", status.Error(codes.NotFound, "failed")), true},
+		{"kitsune error", formatError(&v1.Error{Type: "NoSuchElementException", Msg: &msg}), true},
+		{"derived", &KitshError{Code: codes.NotFound, Msg: "image does not exist"}, true},
+		{"other status", status.Error(codes.Unavailable, "failed"), false},
+		{"exit coder", cli.Exit("not found", ExitNotFound), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isNotFound(test.err); got != test.want {
+				t.Errorf("isNotFound() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// unsafeFileChars matches runs of characters replaced in the names of exported manifest files.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFile is an exported manifest file.
+type exportFile struct {
+	name string
+	docs []interface{}
+}
+
+// Export is a handler for the "export" command.
+func Export(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	inv, err := fetchInventory(cCtx.Context, client)
+	if err != nil {
+		return err
+	}
+
+	files := exportManifests(inv, cCtx.String("name-key"))
+
+	dir := cCtx.String("dir")
+	if dir == "" {
+		return writeManifests(os.Stdout, files...)
+	}
+
+	removed, err := writeManifestDir(dir, files)
+	if err != nil {
+		return err
+	}
+
+	if IsPrettyOutput(cCtx) {
+		PrintSuccess("Exported %d manifest files to %s, removed %d stale ones.\n", len(files), dir, len(removed))
+	}
+	return nil
+}
+
+// writeManifestDir writes the supplied files to dir, then removes the manifest files of earlier exports
+// (vm-*.yaml and image-*.yaml) which aren't among them, so that deleted resources disappear from snapshots.
+// It returns the names of the removed files.
+func writeManifestDir(dir string, files []*exportFile) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool, len(files))
+	for _, file := range files {
+		current[file.name] = true
+
+		f, err := os.Create(filepath.Join(dir, file.name))
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeManifests(f, file)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var removed []string
+	for _, pattern := range []string{"vm-*.yaml", "image-*.yaml"} {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			name := filepath.Base(path)
+			if current[name] {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// writeManifests writes the documents of the supplied files to w as a YAML stream.
+func writeManifests(w io.Writer, files ...*exportFile) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, file := range files {
+		for _, doc := range file.docs {
+			if err := enc.Encode(doc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return enc.Close()
+}
+
+// exportManifests converts the supplied inventory to manifest files, sorted by name: one per virtual machine,
+// including the images first attached to it, and one per image not attached to any virtual machine.
+// Images are referenced in the order they are attached, which is the boot order.
+// Resources are named by the supplied metadata key, falling back to their UUID if it is unset or not unique.
+func exportManifests(inv *inventory, nameKey string) []*exportFile {
+	imageNames := exportNames(len(inv.images), func(i int) (*v1.UUID, map[string]string) {
+		return inv.images[i].GetId(), inv.imageData[i]
+	}, nameKey)
+	vmNames := exportNames(len(inv.vms), func(i int) (*v1.UUID, map[string]string) {
+		return inv.vms[i].GetId(), inv.vmData[i]
+	}, nameKey)
+
+	images := make(map[string]*ImageManifest)
+	for i, image := range inv.images {
+		if inv.imageData[i] == nil {
+			continue // deleted in the meantime
+		}
+
+		images[image.GetId().GetValue()] = &ImageManifest{
+			APIVersion: APIVersion,
+			Kind:       KindImage,
+			Name:       imageNames[image.GetId().GetValue()],
+			Format:     image.GetFormat().String(),
+			Size:       image.GetSize(),
+			Metadata:   exportMetadata(inv.imageData[i], nameKey),
+		}
+	}
+
+	// by name, so that shared images are always exported with the same virtual machine
+	order := make([]int, len(inv.vms))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return vmNames[inv.vms[order[i]].GetId().GetValue()] < vmNames[inv.vms[order[j]].GetId().GetValue()]
+	})
+
+	var vmFiles []*exportFile
+	exported := make(map[string]bool)
+	for _, i := range order {
+		vm := inv.vms[i]
+		if inv.vmData[i] == nil {
+			continue // deleted in the meantime
+		}
+
+		manifest := &VirtualMachineManifest{
+			APIVersion: APIVersion,
+			Kind:       KindVirtualMachine,
+			Name:       vmNames[vm.GetId().GetValue()],
+			Arch:       vm.GetArch().String(),
+			Memory:     vm.GetMemorySize(),
+			Metadata:   exportMetadata(inv.vmData[i], nameKey),
+		}
+
+		file := &exportFile{name: "vm-" + unsafeFileChars.ReplaceAllString(manifest.Name, "_") + ".yaml"}
+		for _, imageId := range inv.vmImages[i] {
+			image, ok := images[imageId.GetValue()]
+			if !ok {
+				manifest.Images = append(manifest.Images, imageId.GetValue()) // deleted in the meantime
+				continue
+			}
+
+			manifest.Images = append(manifest.Images, image.Name)
+			if !exported[image.Name] {
+				exported[image.Name] = true
+				file.docs = append(file.docs, image)
+			}
+		}
+
+		file.docs = append(file.docs, manifest)
+		vmFiles = append(vmFiles, file)
+	}
+
+	var imageFiles []*exportFile
+	for _, image := range images {
+		if !exported[image.Name] {
+			imageFiles = append(imageFiles, &exportFile{
+				name: "image-" + unsafeFileChars.ReplaceAllString(image.Name, "_") + ".yaml",
+				docs: []interface{}{image},
+			})
+		}
+	}
+
+	files := append(vmFiles, imageFiles...)
+	for _, file := range files {
+		sort.SliceStable(file.docs, func(i, j int) bool {
+			// images before the virtual machine, by name
+			a, aOk := file.docs[i].(*ImageManifest)
+			b, bOk := file.docs[j].(*ImageManifest)
+			return aOk && (!bOk || a.Name < b.Name)
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+
+	return files
+}
+
+// exportNames names the supplied resources by their value of the supplied metadata key,
+// falling back to their UUID if the value is unset or shared by multiple resources.
+func exportNames(n int, get func(i int) (*v1.UUID, map[string]string), nameKey string) map[string]string {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		_, data := get(i)
+		if name, ok := data[nameKey]; ok && nameKey != "" && name != "" {
+			counts[name]++
+		}
+	}
+
+	names := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		id, data := get(i)
+		name := data[nameKey]
+		if nameKey == "" || name == "" || counts[name] > 1 {
+			name = id.GetValue()
+		}
+		names[id.GetValue()] = name
+	}
+
+	return names
+}
+
+// exportMetadata strips the keys reserved by "kitsh apply" from the supplied metadata, returning nil if it is empty.
+// Protection is kept, "kitsh apply" leaves it alone.
+func exportMetadata(data map[string]string, nameKey string) map[string]string {
+	exported := copyMetadata(data, nameKey, ManagedByKey)
+	if len(exported) == 0 {
+		return nil
+	}
+	return exported
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExportManifests(t *testing.T) {
+	uuid := func(value string) *v1.UUID { return &v1.UUID{Value: value} }
+	image := func(id string) *v1.Image { return &v1.Image{Id: uuid(id), Format: v1.Image_QCOW2, Size: 1024} }
+	vm := func(id string) *v1.VirtualMachine {
+		return &v1.VirtualMachine{Id: uuid(id), Arch: v1.Architecture_X86_64, MemorySize: 512}
+	}
+
+	inv := &inventory{
+		images: []*v1.Image{image("i-boot"), image("i-data"), image("i-spare"), image("i-dup1"), image("i-dup2")},
+		imageData: []map[string]string{
+			{"name": "zz-boot"},
+			{"name": "aa-data", ManagedByKey: "kitsh", "env": "prod"},
+			{"name": "spare"},
+			{"name": "dup"},
+			{"name": "dup"},
+		},
+		vms:    []*v1.VirtualMachine{vm("v-web"), vm("v-gone"), vm("v-db")},
+		vmData: []map[string]string{{"name": "web", ProtectedKey: "true"}, nil, {}},
+		vmImages: [][]*v1.UUID{
+			{uuid("i-boot"), uuid("i-data"), uuid("i-vanished")},
+			{uuid("i-spare")},
+			{uuid("i-data"), uuid("i-dup2")},
+		},
+	}
+
+	files := exportManifests(inv, "name")
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.name)
+	}
+	wantNames := []string{"image-i-dup1.yaml", "image-spare.yaml", "vm-v-db.yaml", "vm-web.yaml"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("exportManifests() files = %q, want %q", names, wantNames)
+	}
+
+	db := files[2].docs[len(files[2].docs)-1].(*VirtualMachineManifest)
+	if want := []string{"aa-data", "i-dup2"}; !reflect.DeepEqual(db.Images, want) {
+		t.Errorf("vm v-db images = %q, want %q", db.Images, want)
+	}
+
+	web := files[3].docs[len(files[3].docs)-1].(*VirtualMachineManifest)
+	// attachment (boot) order, vanished images by UUID
+	if want := []string{"zz-boot", "aa-data", "i-vanished"}; !reflect.DeepEqual(web.Images, want) {
+		t.Errorf("vm web images = %q, want %q", web.Images, want)
+	}
+	if want := map[string]string{ProtectedKey: "true"}; !reflect.DeepEqual(web.Metadata, want) {
+		t.Errorf("vm web metadata = %v, want %v", web.Metadata, want)
+	}
+
+	// shared images are exported with the first virtual machine by name, images before it by name
+	var webDocs []string
+	for _, doc := range files[3].docs {
+		if image, ok := doc.(*ImageManifest); ok {
+			webDocs = append(webDocs, image.Name)
+		}
+	}
+	if want := []string{"zz-boot"}; !reflect.DeepEqual(webDocs, want) {
+		t.Errorf("vm web image documents = %q, want %q", webDocs, want)
+	}
+
+	data := files[2].docs[0].(*ImageManifest)
+	if want := map[string]string{"env": "prod"}; data.Name != "aa-data" || !reflect.DeepEqual(data.Metadata, want) {
+		t.Errorf("image document = %s with %v, want aa-data with %v", data.Name, data.Metadata, want)
+	}
+}
+
+func TestWriteManifestDirRemovesDeletedResources(t *testing.T) {
+	uuid := func(value string) *v1.UUID { return &v1.UUID{Value: value} }
+	inv := &inventory{
+		images:    []*v1.Image{{Id: uuid("i-root"), Format: v1.Image_QCOW2, Size: 1024}, {Id: uuid("i-spare"), Format: v1.Image_RAW, Size: 2048}},
+		imageData: []map[string]string{{"name": "root"}, {"name": "spare"}},
+		vms: []*v1.VirtualMachine{
+			{Id: uuid("v-web"), Arch: v1.Architecture_X86_64, MemorySize: 512},
+			{Id: uuid("v-db"), Arch: v1.Architecture_X86_64, MemorySize: 1024},
+		},
+		vmData:   []map[string]string{{"name": "web"}, {"name": "db"}},
+		vmImages: [][]*v1.UUID{{uuid("i-root")}, nil},
+	}
+
+	dir := t.TempDir()
+	// not written by kitsh export
+	for _, name := range []string{"README.md", "vm-web.yml", "shared.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("keep"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed, err := writeManifestDir(dir, exportManifests(inv, "name")); err != nil || len(removed) != 0 {
+		t.Fatalf("writeManifestDir() = %q, %v, want nothing removed", removed, err)
+	}
+
+	// the spare image and the db virtual machine are deleted, the root image is detached
+	inv.images, inv.imageData = inv.images[:1], inv.imageData[:1]
+	inv.vms, inv.vmData, inv.vmImages = inv.vms[:1], inv.vmData[:1], [][]*v1.UUID{nil}
+
+	removed, err := writeManifestDir(dir, exportManifests(inv, "name"))
+	if err != nil {
+		t.Fatalf("writeManifestDir() failed: %v", err)
+	}
+	if want := []string{"image-spare.yaml", "vm-db.yaml"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("writeManifestDir() removed %q, want %q", removed, want)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"README.md", "image-root.yaml", "shared.yaml", "vm-web.yaml", "vm-web.yml"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("directory = %q, want %q", names, want)
+	}
+}
@@ -1,14 +1,12 @@
 package handler
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/google/uuid"
-	"github.com/lusory/libkitsune"
 	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
-	"github.com/rodaine/table"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"io"
 	"strings"
@@ -38,50 +36,79 @@ func forEachImages(images v1.ImageRegistryService_GetImagesClient, forEach func(
 	return nil
 }
 
+// findImage finds the image with the supplied ID, failing with a NotFound KitshError if it doesn't exist.
+func findImage(ctx context.Context, registry v1.ImageRegistryServiceClient, id *v1.UUID) (*v1.Image, error) {
+	res, err := registry.FindImage(ctx, &v1.FindImageRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	if res.GetImage() == nil {
+		return nil, &KitshError{Code: codes.NotFound, Msg: fmt.Sprintf("image %s does not exist", id.GetValue())}
+	}
+
+	return res.GetImage(), nil
+}
+
 // ListImages is a handler for the "image list" command.
 func ListImages(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	images, err := client.ImageRegistry.GetImages(cCtx.Context, &emptypb.Empty{})
+	selector, err := selectorFlag(cCtx)
 	if err != nil {
 		return err
 	}
 
-	if cCtx.Bool("no-pretty") {
-		err = forEachImages(images, func(image *v1.Image) error {
-			data, err := json.Marshal(image)
-			if err != nil {
-				return err
-			}
+	stream, err := client.ImageRegistry.GetImages(cCtx.Context, &emptypb.Empty{})
+	if err != nil {
+		return err
+	}
 
-			fmt.Println(string(data))
-			return nil
-		})
-		if err != nil {
+	// the stream is read up front, it isn't kept open while fetching metadata
+	var (
+		images []*v1.Image
+		ids    []*v1.UUID
+	)
+	err = forEachImages(stream, func(image *v1.Image) error {
+		images, ids = append(images, image), append(ids, image.GetId())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := NewOutput(KindImage, "ID", "Format", "Size", "Read-only", "Media type").WithWide("Metadata")
+	wide := isWideOutput(cCtx)
+
+	var data []map[string]string
+	if wide || selector != nil {
+		if data, err = fetchAllMetadata(cCtx.Context, client.ImageRegistry, ids); err != nil {
 			return err
 		}
-	} else {
-		tbl := table.New("ID", "Format", "Size", "Read-only", "Media type")
+	}
 
-		err = forEachImages(images, func(image *v1.Image) error {
-			tbl.AddRow(image.GetId().GetValue(), image.GetFormat().String(), image.GetSize(), image.GetReadOnly(), image.GetMediaType().String())
-			return nil
-		})
-		if err != nil {
-			return err
+	for i, image := range images {
+		row := []interface{}{image.GetId().GetValue(), image.GetFormat().String(), image.GetSize(), image.GetReadOnly(), image.GetMediaType().String()}
+		if data != nil {
+			if data[i] == nil || !selector.Matches(data[i]) { // deleted in the meantime or not selected
+				continue
+			}
+			if wide {
+				row = append(row, formatMetadata(data[i]))
+			}
 		}
-		tbl.Print()
+
+		out.Add(image, row...)
 	}
 
-	return nil
+	return out.Render(cCtx)
 }
 
 // CreateImage is a handler for the "image create" command.
 func CreateImage(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
@@ -96,8 +123,8 @@ func CreateImage(cCtx *cli.Context) error {
 		return UnknownFormat
 	}
 
-	data := make(map[string]string)
-	if err := json.Unmarshal([]byte(cCtx.String("data")), &data); err != nil {
+	data, err := metadataFlags(cCtx)
+	if err != nil {
 		return err
 	}
 
@@ -121,81 +148,153 @@ func CreateImage(cCtx *cli.Context) error {
 
 	image := oneof.GetImage()
 
-	if cCtx.Bool("no-pretty") {
-		data, err := json.Marshal(image)
-		if err != nil {
-			return err
-		}
-
-		fmt.Println(string(data))
-	} else {
-		tbl := table.New("ID", "Format", "Size", "Read-only", "Media type", "Metadata")
-		tbl.AddRow(
-			image.GetId().GetValue(),
-			image.GetFormat().String(),
-			image.GetSize(),
-			image.GetReadOnly(),
-			image.GetMediaType().String(),
-		)
-		tbl.Print()
-	}
+	out := NewOutput(KindImage, "ID", "Format", "Size", "Read-only", "Media type", "Metadata")
+	out.Add(
+		image,
+		image.GetId().GetValue(),
+		image.GetFormat().String(),
+		image.GetSize(),
+		image.GetReadOnly(),
+		image.GetMediaType().String(),
+		formatMetadata(data),
+	)
 
-	return nil
+	return out.Render(cCtx)
 }
 
 // DeleteImage is a handler for the "image delete" command.
 func DeleteImage(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	ids, err := newImageResolver(cCtx, client).Targets(cCtx)
 	if err != nil {
 		return err
 	}
 
-	res, err := client.ImageRegistry.DeleteImage(
-		cCtx.Context,
-		&v1.DeleteImageRequest{
-			Id: &v1.UUID{
-				Value: id.String(),
-			},
+	att, err := fetchAttachments(cCtx.Context, client)
+	if err != nil {
+		return err
+	}
+
+	if !cCtx.Bool("force") {
+		err := forEachTarget(ids, func(id *v1.UUID) error {
+			return refuseAttached(att, id, "use --force to detach it first")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var attachedTo []*v1.UUID
+	for _, id := range ids {
+		attachedTo = append(attachedTo, att.imageVms[id.GetValue()]...)
+	}
+	err = runConcurrently(
+		func() error {
+			return checkProtected(cCtx.Context, client.ImageRegistry, KindImage, "delete", ids...)
+		},
+		func() error {
+			return checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, "detach images from", attachedTo...)
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	if err := confirm(cCtx, client, &confirmation{verb: "delete", kind: KindImage, ids: ids}); err != nil {
+		return err
+	}
+
+	return forEachTarget(ids, func(id *v1.UUID) error {
+		if err := detachAll(cCtx.Context, client, att, id); err != nil {
+			return err
+		}
+
+		return deleteImage(cCtx.Context, client, id)
+	})
+}
 
+// ProtectImage is a handler for the "image protect" command.
+func ProtectImage(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
-	if res.GetError() != nil {
-		return formatError(res.GetError())
+
+	return ProtectFunc(client.ImageRegistry, newImageResolver(cCtx, client), true)(cCtx)
+}
+
+// UnprotectImage is a handler for the "image unprotect" command.
+func UnprotectImage(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return ProtectFunc(client.ImageRegistry, newImageResolver(cCtx, client), false)(cCtx)
 }
 
 // GetImageMetadata is a handler for the "image metadata" command.
 func GetImageMetadata(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	return GetMetadataFunc(client.ImageRegistry)(cCtx)
+	return GetMetadataFunc(client.ImageRegistry, newImageResolver(cCtx, client))(cCtx)
 }
 
 // SetImageMetadata is a handler for the "image metadata set" command.
 func SetImageMetadata(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	return SetMetadataFunc(client.ImageRegistry, newImageResolver(cCtx, client))(cCtx)
+}
+
+// PatchImageMetadata is a handler for the "image metadata patch" command.
+func PatchImageMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	return SetMetadataFunc(client.ImageRegistry)(cCtx)
+	return PatchMetadataFunc(client.ImageRegistry, newImageResolver(cCtx, client))(cCtx)
+}
+
+// EditImageMetadata is a handler for the "image metadata edit" command.
+func EditImageMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	return EditMetadataFunc(client.ImageRegistry, newImageResolver(cCtx, client))(cCtx)
 }
 
 // ClearImageMetadata is a handler for the "image metadata clear" command.
 func ClearImageMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ids, err := newImageResolver(cCtx, client).Targets(cCtx)
+	if err != nil {
+		return err
+	}
+	if err := checkProtected(cCtx.Context, client.ImageRegistry, KindImage, "clear the metadata of", ids...); err != nil {
+		return err
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: "clear the metadata of", kind: KindImage, ids: ids}); err != nil {
+		return err
+	}
+
 	if err := cCtx.Set("data", "{}"); err != nil {
 		return err
 	}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// inventory is a snapshot of all virtual machines and images of kitsune, along with their metadata and attachments.
+// Resources deleted while taking the snapshot have nil metadata.
+type inventory struct {
+	images    []*v1.Image
+	imageData []map[string]string
+	vms       []*v1.VirtualMachine
+	vmData    []map[string]string
+	// vmImages are the IDs of the images attached to the virtual machines.
+	vmImages [][]*v1.UUID
+}
+
+// fetchInventory fetches all virtual machines and images, then their metadata and attachments with bounded concurrency.
+func fetchInventory(ctx context.Context, client *libkitsune.KitsuneClient) (*inventory, error) {
+	inv := &inventory{}
+	err := runConcurrently(
+		func() error {
+			stream, err := client.ImageRegistry.GetImages(ctx, &emptypb.Empty{})
+			if err != nil {
+				return err
+			}
+			return forEachImages(stream, func(image *v1.Image) error {
+				inv.images = append(inv.images, image)
+				return nil
+			})
+		},
+		func() error {
+			stream, err := client.VmRegistry.GetVirtualMachines(ctx, &emptypb.Empty{})
+			if err != nil {
+				return err
+			}
+			return forEachVms(stream, func(vm *v1.VirtualMachine) error {
+				inv.vms = append(inv.vms, vm)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.imageData = make([]map[string]string, len(inv.images))
+	inv.vmData = make([]map[string]string, len(inv.vms))
+	inv.vmImages = make([][]*v1.UUID, len(inv.vms))
+
+	tasks := make([]func() error, 0, len(inv.images)+len(inv.vms))
+	for i, image := range inv.images {
+		i, image := i, image
+		tasks = append(tasks, func() error {
+			data, err := fetchMetadata(ctx, client.ImageRegistry, image.GetId())
+			if isNotFound(err) {
+				return nil // deleted in the meantime
+			}
+
+			inv.imageData[i] = data
+			return err
+		})
+	}
+	for i, vm := range inv.vms {
+		i, vm := i, vm
+		tasks = append(tasks, func() error {
+			data, err := fetchMetadata(ctx, client.VmRegistry, vm.GetId())
+			var images []*v1.UUID
+			if err == nil {
+				images, err = fetchAttachedImageIds(ctx, client.VmRegistry, vm.GetId())
+			}
+			if isNotFound(err) {
+				return nil // deleted in the meantime
+			}
+
+			inv.vmData[i], inv.vmImages[i] = data, images
+			return err
+		})
+	}
+
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
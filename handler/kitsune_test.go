@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKitsune is the in-memory state of a kitsune server for tests, served by fakeVmRegistry and fakeImageRegistry.
+// Metadata is held by memoryRegistry instances.
+type fakeKitsune struct {
+	mu        sync.Mutex
+	vms       []*v1.VirtualMachine
+	images    []*v1.Image
+	vmData    *memoryRegistry
+	imageData *memoryRegistry
+	// attached are the UUIDs of the images attached to the virtual machines, by virtual machine UUID.
+	attached map[string][]string
+	alive    map[string]bool
+	// stopping are the numbers of IsAlive calls virtual machines keep running for after a power off, by UUID.
+	stopping map[string]int
+	// acpiPolls and powerdownPolls are the numbers of IsAlive calls a virtual machine keeps running for
+	// after POWERDOWN_ACPI and POWERDOWN, a negative number ignores the power action.
+	acpiPolls, powerdownPolls int
+	// vanished are virtual machines still listed, but already deleted otherwise.
+	vanished map[string]bool
+	// broken are virtual machines whose attached images can't be fetched.
+	broken map[string]bool
+	// calls are the calls modifying state, like "DetachImage <vm> <image>".
+	calls []string
+}
+
+// newFakeKitsune creates an empty fakeKitsune stopping virtual machines right after power actions.
+func newFakeKitsune() *fakeKitsune {
+	return &fakeKitsune{
+		vmData:    &memoryRegistry{data: make(map[string]map[string]string)},
+		imageData: &memoryRegistry{data: make(map[string]map[string]string)},
+		attached:  make(map[string][]string),
+		alive:     make(map[string]bool),
+		stopping:  make(map[string]int),
+		vanished:  make(map[string]bool),
+		broken:    make(map[string]bool),
+	}
+}
+
+// addVm adds a virtual machine with the supplied metadata and the supplied images attached.
+func (k *fakeKitsune) addVm(id string, alive bool, data map[string]string, images ...string) {
+	k.vms = append(k.vms, &v1.VirtualMachine{Id: &v1.UUID{Value: id}, Arch: v1.Architecture_X86_64, MemorySize: 512})
+	k.vmData.data[id] = data
+	k.attached[id] = images
+	k.alive[id] = alive
+}
+
+// addImage adds an image with the supplied metadata.
+func (k *fakeKitsune) addImage(id string, data map[string]string) {
+	k.images = append(k.images, &v1.Image{Id: &v1.UUID{Value: id}, Format: v1.Image_QCOW2, Size: 1024})
+	k.imageData.data[id] = data
+}
+
+// start starts a gRPC server with the registries of the fakeKitsune and returns its address.
+func (k *fakeKitsune) start(t *testing.T) string {
+	t.Helper()
+
+	return serveWith(t, "tcp", "127.0.0.1:0", func(server *grpc.Server) {
+		v1.RegisterVirtualMachineRegistryServiceServer(server, &fakeVmRegistry{k: k})
+		v1.RegisterImageRegistryServiceServer(server, &fakeImageRegistry{k: k})
+	})
+}
+
+// serve starts a gRPC server with the registries of the fakeKitsune and connects to it.
+func (k *fakeKitsune) serve(t *testing.T) *libkitsune.KitsuneClient {
+	t.Helper()
+
+	client, err := dial(&Settings{Target: k.start(t), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Cc.Close() })
+
+	return client
+}
+
+// record records a call modifying state.
+func (k *fakeKitsune) record(format string, args ...interface{}) {
+	k.calls = append(k.calls, fmt.Sprintf(format, args...))
+}
+
+// findVm finds the index of the supplied virtual machine, -1 if it doesn't exist.
+func (k *fakeKitsune) findVm(id string) int {
+	for i, vm := range k.vms {
+		if vm.GetId().GetValue() == id && !k.vanished[id] {
+			return i
+		}
+	}
+	return -1
+}
+
+// fakeError creates a kitsune.proto.v1.Error.
+func fakeError(errType, format string, args ...interface{}) *v1.Error {
+	msg := fmt.Sprintf(format, args...)
+	return &v1.Error{Type: errType, Msg: &msg}
+}
+
+// fakeVmRegistry is the virtual machine registry of a fakeKitsune.
+type fakeVmRegistry struct {
+	v1.UnimplementedVirtualMachineRegistryServiceServer
+	k *fakeKitsune
+}
+
+func (r *fakeVmRegistry) GetVirtualMachines(_ *emptypb.Empty, stream v1.VirtualMachineRegistryService_GetVirtualMachinesServer) error {
+	r.k.mu.Lock()
+	vms := append([]*v1.VirtualMachine(nil), r.k.vms...)
+	r.k.mu.Unlock()
+
+	for _, vm := range vms {
+		if err := stream.Send(vm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fakeVmRegistry) FindVirtualMachine(_ context.Context, in *v1.FindVirtualMachineRequest) (*v1.FindVirtualMachineResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	if i := r.k.findVm(in.GetId().GetValue()); i >= 0 {
+		return &v1.FindVirtualMachineResponse{Machine: r.k.vms[i]}, nil
+	}
+	return &v1.FindVirtualMachineResponse{}, nil
+}
+
+func (r *fakeVmRegistry) DeleteVirtualMachine(_ context.Context, in *v1.DeleteVirtualMachineRequest) (*v1.DeleteVirtualMachineResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	id := in.GetId().GetValue()
+	i := r.k.findVm(id)
+	if i < 0 {
+		return &v1.DeleteVirtualMachineResponse{Error: fakeError("NotFound", "no virtual machine %s", id)}, nil
+	}
+
+	r.k.record("DeleteVirtualMachine %s", id)
+	r.k.vms = append(r.k.vms[:i:i], r.k.vms[i+1:]...)
+	delete(r.k.attached, id)
+	return &v1.DeleteVirtualMachineResponse{}, nil
+}
+
+func (r *fakeVmRegistry) IsAlive(_ context.Context, in *v1.IsAliveRequest) (*v1.IsAliveResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	id := in.GetId().GetValue()
+	if r.k.findVm(id) < 0 {
+		return &v1.IsAliveResponse{AliveOrError: &v1.IsAliveResponse_Error{Error: fakeError("NotFound", "no virtual machine %s", id)}}, nil
+	}
+
+	if polls, ok := r.k.stopping[id]; ok {
+		if polls <= 0 {
+			r.k.alive[id] = false
+			delete(r.k.stopping, id)
+		} else {
+			r.k.stopping[id] = polls - 1
+		}
+	}
+	return &v1.IsAliveResponse{AliveOrError: &v1.IsAliveResponse_Alive{Alive: r.k.alive[id]}}, nil
+}
+
+func (r *fakeVmRegistry) GetAttachedImages(_ context.Context, in *v1.GetAttachedImagesRequest) (*v1.GetAttachedImagesResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	id := in.GetId().GetValue()
+	if r.k.findVm(id) < 0 {
+		return &v1.GetAttachedImagesResponse{Error: fakeError("NotFound", "no virtual machine %s", id)}, nil
+	}
+	if r.k.broken[id] {
+		return &v1.GetAttachedImagesResponse{Error: fakeError("RuntimeException", "virtual machine %s is broken", id)}, nil
+	}
+
+	var images []*v1.UUID
+	for _, image := range r.k.attached[id] {
+		images = append(images, &v1.UUID{Value: image})
+	}
+	return &v1.GetAttachedImagesResponse{Images: images}, nil
+}
+
+func (r *fakeVmRegistry) AttachImage(_ context.Context, in *v1.AttachImageRequest) (*v1.AttachImageResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	vm, image := in.GetMachine().GetValue(), in.GetImage().GetValue()
+	r.k.record("AttachImage %s %s", vm, image)
+	r.k.attached[vm] = append(r.k.attached[vm], image)
+	return &v1.AttachImageResponse{}, nil
+}
+
+func (r *fakeVmRegistry) DetachImage(_ context.Context, in *v1.DetachImageRequest) (*v1.DetachImageResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	vm, image := in.GetMachine().GetValue(), in.GetImage().GetValue()
+	if r.k.alive[vm] {
+		return &v1.DetachImageResponse{Error: fakeError("IllegalStateException", "virtual machine %s is running", vm)}, nil
+	}
+
+	r.k.record("DetachImage %s %s", vm, image)
+	var remaining []string
+	for _, other := range r.k.attached[vm] {
+		if other != image {
+			remaining = append(remaining, other)
+		}
+	}
+	r.k.attached[vm] = remaining
+	return &v1.DetachImageResponse{}, nil
+}
+
+func (r *fakeVmRegistry) SendPowerAction(_ context.Context, in *v1.SendPowerActionRequest) (*v1.SendPowerActionResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	id := in.GetMachine().GetValue()
+	r.k.record("SendPowerAction %s %s", id, in.GetAction())
+
+	switch in.GetAction() {
+	case v1.PowerAction_POWERON, v1.PowerAction_RESET:
+		r.k.alive[id] = true
+		delete(r.k.stopping, id)
+	case v1.PowerAction_POWERDOWN_ACPI:
+		if r.k.alive[id] && r.k.acpiPolls >= 0 {
+			r.k.stopping[id] = r.k.acpiPolls
+		}
+	default:
+		if r.k.alive[id] && r.k.powerdownPolls >= 0 {
+			r.k.stopping[id] = r.k.powerdownPolls
+		}
+	}
+	return &v1.SendPowerActionResponse{}, nil
+}
+
+func (r *fakeVmRegistry) GetMetadata(ctx context.Context, in *v1.GetMetadataRequest) (*v1.GetMetadataResponse, error) {
+	return r.k.vmData.GetMetadata(ctx, in)
+}
+
+func (r *fakeVmRegistry) SetMetadata(ctx context.Context, in *v1.SetMetadataRequest) (*v1.SetMetadataResponse, error) {
+	return r.k.vmData.SetMetadata(ctx, in)
+}
+
+// fakeImageRegistry is the image registry of a fakeKitsune.
+type fakeImageRegistry struct {
+	v1.UnimplementedImageRegistryServiceServer
+	k *fakeKitsune
+}
+
+func (r *fakeImageRegistry) GetImages(_ *emptypb.Empty, stream v1.ImageRegistryService_GetImagesServer) error {
+	r.k.mu.Lock()
+	images := append([]*v1.Image(nil), r.k.images...)
+	r.k.mu.Unlock()
+
+	for _, image := range images {
+		if err := stream.Send(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fakeImageRegistry) FindImage(_ context.Context, in *v1.FindImageRequest) (*v1.FindImageResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	for _, image := range r.k.images {
+		if image.GetId().GetValue() == in.GetId().GetValue() {
+			return &v1.FindImageResponse{Image: image}, nil
+		}
+	}
+	return &v1.FindImageResponse{}, nil
+}
+
+func (r *fakeImageRegistry) DeleteImage(_ context.Context, in *v1.DeleteImageRequest) (*v1.DeleteImageResponse, error) {
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+
+	id := in.GetId().GetValue()
+	for i, image := range r.k.images {
+		if image.GetId().GetValue() == id {
+			r.k.record("DeleteImage %s", id)
+			r.k.images = append(r.k.images[:i:i], r.k.images[i+1:]...)
+			return &v1.DeleteImageResponse{}, nil
+		}
+	}
+	return &v1.DeleteImageResponse{Error: fakeError("NotFound", "no image %s", id)}, nil
+}
+
+func (r *fakeImageRegistry) GetMetadata(ctx context.Context, in *v1.GetMetadataRequest) (*v1.GetMetadataResponse, error) {
+	return r.k.imageData.GetMetadata(ctx, in)
+}
+
+func (r *fakeImageRegistry) SetMetadata(ctx context.Context, in *v1.SetMetadataRequest) (*v1.SetMetadataResponse, error) {
+	return r.k.imageData.SetMetadata(ctx, in)
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// InvalidManifest is an error about a malformed or inconsistent manifest.
+var InvalidManifest = errors.New("invalid manifest")
+
+// ImageManifest is the desired state of an image.
+type ImageManifest struct {
+	APIVersion string            `yaml:"apiVersion" json:"apiVersion"`
+	Kind       Kind              `yaml:"kind" json:"kind"`
+	Name       string            `yaml:"name" json:"name"`
+	Format     string            `yaml:"format" json:"format"`
+	Size       uint64            `yaml:"size" json:"size"`
+	Metadata   map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// VirtualMachineManifest is the desired state of a virtual machine, images are referenced by the names
+// of image manifests or by the UUIDs of existing images.
+type VirtualMachineManifest struct {
+	APIVersion string            `yaml:"apiVersion" json:"apiVersion"`
+	Kind       Kind              `yaml:"kind" json:"kind"`
+	Name       string            `yaml:"name" json:"name"`
+	Arch       string            `yaml:"arch" json:"arch"`
+	Memory     uint64            `yaml:"memory" json:"memory"`
+	Images     []string          `yaml:"images,omitempty" json:"images,omitempty"`
+	Metadata   map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// Manifests is the desired state described by a set of manifest documents.
+type Manifests struct {
+	Images          []*ImageManifest
+	VirtualMachines []*VirtualMachineManifest
+}
+
+// manifestHeader is the part shared by all manifest documents.
+type manifestHeader struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       Kind   `yaml:"kind"`
+}
+
+// loadManifests loads the manifests in the supplied files, directories (YAML and JSON files directly inside them)
+// and "-" for stdin.
+func loadManifests(paths []string) (*Manifests, error) {
+	manifests := &Manifests{}
+	for _, path := range paths {
+		files := []string{path}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			if files, err = manifestFiles(path); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		for _, file := range files {
+			var content []byte
+			if file == "-" {
+				content, err = io.ReadAll(os.Stdin)
+			} else {
+				content, err = os.ReadFile(file)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if err := manifests.parse(file, content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return manifests, nil
+}
+
+// manifestFiles lists the YAML and JSON files in the supplied directory, sorted by name.
+func manifestFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// parse parses all documents of a manifest file into the manifests.
+func (m *Manifests) parse(file string, content []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for i := 1; ; i++ {
+		var node yaml.Node
+		if err := dec.Decode(&node); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %s: %s", InvalidManifest, file, err)
+		}
+		if len(node.Content) == 0 || node.Content[0].Tag == "!!null" {
+			continue // empty document
+		}
+
+		if err := m.parseDocument(&node); err != nil {
+			return fmt.Errorf("%w: %s: document %d: %s", InvalidManifest, file, i, err)
+		}
+	}
+}
+
+// parseDocument parses a single manifest document, rejecting unknown fields.
+func (m *Manifests) parseDocument(node *yaml.Node) error {
+	header := manifestHeader{}
+	if err := node.Decode(&header); err != nil {
+		return err
+	}
+	if header.APIVersion != APIVersion {
+		return fmt.Errorf("unsupported apiVersion %q, expected %q", header.APIVersion, APIVersion)
+	}
+
+	// yaml.Node.Decode can't reject unknown fields, so the document is decoded again
+	raw, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+
+	switch header.Kind {
+	case KindImage:
+		image := &ImageManifest{}
+		if err := dec.Decode(image); err != nil {
+			return err
+		}
+		m.Images = append(m.Images, image)
+	case KindVirtualMachine:
+		vm := &VirtualMachineManifest{}
+		if err := dec.Decode(vm); err != nil {
+			return err
+		}
+		m.VirtualMachines = append(m.VirtualMachines, vm)
+	default:
+		return fmt.Errorf("unsupported kind %q, expected %s or %s", header.Kind, KindImage, KindVirtualMachine)
+	}
+
+	return nil
+}
+
+// validate checks the manifests for missing or duplicate names, invalid fields, unknown image references
+// and metadata keys reserved by "kitsh apply".
+func (m *Manifests) validate(reserved ...string) error {
+	images := make(map[string]bool)
+	for _, image := range m.Images {
+		if err := validateManifestName("image", image.Name, images, image.Metadata, reserved); err != nil {
+			return err
+		}
+		if _, ok := v1.Image_Format_value[strings.ToUpper(image.Format)]; !ok {
+			return fmt.Errorf("%w: image %s: %s %q", InvalidManifest, image.Name, UnknownFormat, image.Format)
+		}
+		if image.Size <= 0 {
+			return fmt.Errorf("%w: image %s: %s", InvalidManifest, image.Name, InvalidImageSize)
+		}
+	}
+
+	vms := make(map[string]bool)
+	for _, vm := range m.VirtualMachines {
+		if err := validateManifestName("virtual machine", vm.Name, vms, vm.Metadata, reserved); err != nil {
+			return err
+		}
+		if _, ok := v1.Architecture_value[strings.ToUpper(vm.Arch)]; !ok {
+			return fmt.Errorf("%w: virtual machine %s: %s %q", InvalidManifest, vm.Name, UnknownArchitecture, vm.Arch)
+		}
+		if vm.Memory <= 0 {
+			return fmt.Errorf("%w: virtual machine %s: %s", InvalidManifest, vm.Name, InvalidRAMSize)
+		}
+
+		refs := make(map[string]bool)
+		for _, ref := range vm.Images {
+			if _, err := uuid.Parse(ref); err != nil && !images[ref] {
+				return fmt.Errorf("%w: virtual machine %s: image %s is neither a manifest nor a UUID", InvalidManifest, vm.Name, ref)
+			}
+			if refs[ref] {
+				return fmt.Errorf("%w: virtual machine %s: image %s is listed twice", InvalidManifest, vm.Name, ref)
+			}
+			refs[ref] = true
+		}
+	}
+
+	return nil
+}
+
+// validateManifestName checks that the supplied name is set and unique, recording it in seen,
+// and that the supplied metadata doesn't set reserved keys.
+func validateManifestName(noun, name string, seen map[string]bool, data map[string]string, reserved []string) error {
+	if name == "" {
+		return fmt.Errorf("%w: %s without a name", InvalidManifest, noun)
+	}
+	if seen[name] {
+		return fmt.Errorf("%w: duplicate %s %s", InvalidManifest, noun, name)
+	}
+	seen[name] = true
+
+	for _, key := range reserved {
+		if _, ok := data[key]; ok {
+			return fmt.Errorf("%w: %s %s: metadata key %s is managed by kitsh apply", InvalidManifest, noun, name, key)
+		}
+	}
+	return nil
+}
@@ -3,87 +3,422 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
 	"github.com/urfave/cli/v2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// maxMetadataWriteAttempts is the maximum number of read-modify-write attempts of a metadata update
+// before giving up because of concurrent modifications.
+const maxMetadataWriteAttempts = 5
+
+// InvalidMetadata is an error about malformed metadata input.
+var InvalidMetadata = errors.New("invalid metadata")
+
+// MissingMetadata is an error about no metadata being supplied to a command requiring it.
+var MissingMetadata = errors.New("no metadata supplied, use --data, --meta or --meta-file")
+
+// InvalidMetadataPatch is an error about a malformed metadata patch.
+var InvalidMetadataPatch = errors.New("invalid metadata patch")
+
+// MetadataPatch is a JSON merge patch (RFC 7386) of a metadata map, nil values unset keys.
+type MetadataPatch map[string]*string
+
 // MetadatableRegistry is a registry that allows for CRUD operations with metadata.
 type MetadatableRegistry interface {
 	GetMetadata(ctx context.Context, in *v1.GetMetadataRequest, opts ...grpc.CallOption) (*v1.GetMetadataResponse, error)
 	SetMetadata(ctx context.Context, in *v1.SetMetadataRequest, opts ...grpc.CallOption) (*v1.SetMetadataResponse, error)
 }
 
-// GetMetadataFunc produces a handler for "metadata" commands.
-func GetMetadataFunc(registry MetadatableRegistry) func(cCtx *cli.Context) error {
+// GetMetadataFunc produces a handler for "metadata" and "metadata get" commands, resolving the "id" flag
+// with the supplied Resolver. If the "key" flag is supplied, only its value is printed.
+func GetMetadataFunc(registry MetadatableRegistry, resolver *Resolver) func(cCtx *cli.Context) error {
 	return func(cCtx *cli.Context) error {
-		id, err := uuid.Parse(cCtx.String("id"))
+		id, err := resolver.Resolve(cCtx.Context, cCtx.String("id"))
 		if err != nil {
 			return err
 		}
 
-		meta, err := registry.GetMetadata(
-			cCtx.Context,
-			&v1.GetMetadataRequest{
-				Id: &v1.UUID{
-					Value: id.String(),
-				},
-			},
-		)
-
+		data, err := fetchMetadata(cCtx.Context, registry, id)
 		if err != nil {
 			return err
 		}
-		if meta.GetError() != nil {
-			return formatError(meta.GetError())
+
+		if isSetLocally(cCtx, "key") { // the global --key flag must not be mistaken for it
+			key := cCtx.String("key")
+			value, ok := data[key]
+			if !ok {
+				return &KitshError{Code: codes.NotFound, Msg: fmt.Sprintf("metadata key %s is not set", key)}
+			}
+
+			format, _, err := outputFormat(cCtx)
+			if err != nil {
+				return err
+			}
+			if format == OutputTable || format == OutputWide {
+				fmt.Println(value) // bare value for scripting
+				return nil
+			}
+
+			data = map[string]string{key: value}
 		}
 
-		data := meta.GetMeta().GetData()
-		if data != nil {
-			data0, _ := json.Marshal(data)
-			fmt.Println(string(data0))
-		} else {
-			fmt.Println("{}")
+		out := NewOutput(KindMetadata, "Key", "Value")
+		out.AddItem(Metadata{Id: id, Data: data})
+		for _, key := range sortedKeys(data) {
+			out.AddRow(key, data[key])
 		}
 
-		return nil
+		return out.Render(cCtx)
 	}
 }
 
-// SetMetadataFunc produces a handler for "metadata set" commands.
-func SetMetadataFunc(registry MetadatableRegistry) func(cCtx *cli.Context) error {
+// SetMetadataFunc produces a handler for "metadata set" commands, resolving the "id" or "selector" flag
+// with the supplied Resolver.
+func SetMetadataFunc(registry MetadatableRegistry, resolver *Resolver) func(cCtx *cli.Context) error {
 	return func(cCtx *cli.Context) error {
-		id, err := uuid.Parse(cCtx.String("id"))
+		if cCtx.String("data") == "" && !cCtx.IsSet("meta") && !cCtx.IsSet("meta-file") {
+			return MissingMetadata
+		}
+
+		data, err := metadataFlags(cCtx)
 		if err != nil {
 			return err
 		}
 
-		data := make(map[string]string)
-		if err := json.Unmarshal([]byte(cCtx.String("data")), &data); err != nil {
+		ids, err := resolver.Targets(cCtx)
+		if err != nil {
 			return err
 		}
 
-		res, err := registry.SetMetadata(
-			cCtx.Context,
-			&v1.SetMetadataRequest{
-				Id: &v1.UUID{
-					Value: id.String(),
-				},
-				Meta: &v1.MetadataMap{
-					Data: data,
-				},
-			},
-		)
+		return forEachTarget(ids, func(id *v1.UUID) error {
+			// the protection is kept unless the metadata sets it, replacing the metadata mustn't lift it
+			return updateMetadata(cCtx.Context, registry, id, func(existing map[string]string) (map[string]string, error) {
+				updated := make(map[string]string, len(data)+1)
+				if protected, ok := existing[ProtectedKey]; ok {
+					updated[ProtectedKey] = protected
+				}
+				for key, value := range data {
+					updated[key] = value
+				}
+				return updated, nil
+			})
+		})
+	}
+}
+
+// PatchMetadataFunc produces a handler for "metadata patch" commands, resolving the "id" or "selector" flag
+// with the supplied Resolver.
+func PatchMetadataFunc(registry MetadatableRegistry, resolver *Resolver) func(cCtx *cli.Context) error {
+	return func(cCtx *cli.Context) error {
+		patch, err := parseMetadataPatch(cCtx)
+		if err != nil {
+			return err
+		}
 
+		ids, err := resolver.Targets(cCtx)
 		if err != nil {
 			return err
 		}
-		if res.GetError() != nil {
-			return formatError(res.GetError())
+
+		return forEachTarget(ids, func(id *v1.UUID) error {
+			return updateMetadata(cCtx.Context, registry, id, func(data map[string]string) (map[string]string, error) {
+				return patch.Apply(data), nil
+			})
+		})
+	}
+}
+
+// parseMetadataPatch builds a MetadataPatch from the "data" (a JSON merge patch), "set" and "unset" flags,
+// applied in this order.
+func parseMetadataPatch(cCtx *cli.Context) (MetadataPatch, error) {
+	patch := make(MetadataPatch)
+	if cCtx.IsSet("data") {
+		input, err := readInput(cCtx.String("data"))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(input, &patch); err != nil {
+			return nil, fmt.Errorf("%w: %s, values must be strings or null", InvalidMetadataPatch, err)
+		}
+	}
+
+	for _, pair := range cCtx.StringSlice("set") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %q is not in the key=value format", InvalidMetadataPatch, pair)
 		}
+		patch[key] = &value
+	}
+	for _, key := range cCtx.StringSlice("unset") {
+		patch[key] = nil
+	}
 
+	if len(patch) == 0 {
+		return nil, fmt.Errorf("%w: nothing to change, use --set, --unset or --data", InvalidMetadataPatch)
+	}
+	return patch, nil
+}
+
+// metadataFlags builds a metadata map from the "data" (JSON, @file or - for stdin), "meta-file" (YAML or .env)
+// and "meta" (key=value or key=@file) flags, later ones overriding keys of earlier ones.
+func metadataFlags(cCtx *cli.Context) (map[string]string, error) {
+	data := make(map[string]string)
+	if value := cCtx.String("data"); value != "" {
+		input, err := readInput(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(input, &data); err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidMetadata, err)
+		}
+		if data == nil { // "null"
+			data = make(map[string]string)
+		}
+	}
+
+	for _, path := range cCtx.StringSlice("meta-file") {
+		fileData, err := readMetadataFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileData {
+			data[key] = value
+		}
+	}
+
+	for _, pair := range cCtx.StringSlice("meta") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %q is not in the key=value format", InvalidMetadata, pair)
+		}
+
+		if strings.HasPrefix(value, "@") {
+			content, err := os.ReadFile(value[1:])
+			if err != nil {
+				return nil, err
+			}
+			value = string(content)
+		}
+		data[key] = value
+	}
+
+	return data, nil
+}
+
+// readInput reads the value of a flag accepting inline input, "@path" to read a file or "-" to read stdin.
+func readInput(value string) ([]byte, error) {
+	switch {
+	case value == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(value, "@"):
+		return os.ReadFile(value[1:])
+	}
+
+	return []byte(value), nil
+}
+
+// readMetadataFile reads a metadata map from a .env file (by extension) or a YAML file (otherwise, including JSON).
+func readMetadataFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) == ".env" || filepath.Base(path) == ".env" {
+		return parseDotenv(path, string(content))
+	}
+
+	data := make(map[string]string)
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", InvalidMetadata, path, err)
+	}
+	return data, nil
+}
+
+// parseDotenv parses "KEY=value" lines, ignoring blank lines, comments and "export " prefixes.
+// Double-quoted values are unquoted like Go strings, single-quoted values are taken literally.
+func parseDotenv(path, content string) (map[string]string, error) {
+	data := make(map[string]string)
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %s:%d: expected KEY=value", InvalidMetadata, path, i+1)
+		}
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s:%d: %s", InvalidMetadata, path, i+1, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+		data[key] = value
+	}
+
+	return data, nil
+}
+
+// Apply applies the patch to a copy of the supplied metadata map.
+func (p MetadataPatch) Apply(data map[string]string) map[string]string {
+	patched := make(map[string]string, len(data)+len(p))
+	for key, value := range data {
+		patched[key] = value
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(patched, key)
+		} else {
+			patched[key] = *value
+		}
+	}
+
+	return patched
+}
+
+// updateMetadata modifies the metadata of the supplied registry entry with the supplied function as a
+// read-modify-write, retrying if it was changed concurrently (see writeMetadata).
+func updateMetadata(
+	ctx context.Context,
+	registry MetadatableRegistry,
+	id *v1.UUID,
+	modify func(data map[string]string) (map[string]string, error),
+) error {
+	for attempt := 1; ; attempt++ {
+		base, err := fetchMetadata(ctx, registry, id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := modify(base)
+		if err != nil {
+			return err
+		}
+
+		err = writeMetadata(ctx, registry, id, base, updated)
+		if kErr, ok := asKitshError(err); ok && kErr.Code == codes.Aborted && attempt < maxMetadataWriteAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// writeMetadata replaces the metadata of the supplied registry entry with updated if it still equals base,
+// failing with an Aborted KitshError otherwise. Nothing is written if updated equals base.
+// kitsune has no conditional writes, so this only narrows the window for lost updates, it doesn't close it.
+func writeMetadata(ctx context.Context, registry MetadatableRegistry, id *v1.UUID, base, updated map[string]string) error {
+	if equalMetadata(base, updated) {
 		return nil
 	}
+
+	current, err := fetchMetadata(ctx, registry, id)
+	if err != nil {
+		return err
+	}
+	if !equalMetadata(base, current) {
+		return &KitshError{Code: codes.Aborted, Msg: fmt.Sprintf("metadata of %s was modified concurrently", id.GetValue())}
+	}
+
+	res, err := registry.SetMetadata(ctx, &v1.SetMetadataRequest{Id: id, Meta: &v1.MetadataMap{Data: updated}})
+	if err != nil {
+		return err
+	}
+	if res.GetError() != nil {
+		return formatError(res.GetError())
+	}
+
+	return nil
+}
+
+// equalMetadata checks whether the supplied metadata maps hold the same entries.
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchMetadata gets the metadata of the supplied registry entry, never returning a nil map on success.
+func fetchMetadata(ctx context.Context, registry MetadatableRegistry, id *v1.UUID) (map[string]string, error) {
+	meta, err := registry.GetMetadata(ctx, &v1.GetMetadataRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	if meta.GetError() != nil {
+		return nil, formatError(meta.GetError())
+	}
+
+	data := meta.GetMeta().GetData()
+	if data == nil {
+		data = make(map[string]string)
+	}
+
+	return data, nil
+}
+
+// fetchAllMetadata gets the metadata of the supplied registry entries with bounded concurrency,
+// entries deleted in the meantime have nil metadata.
+func fetchAllMetadata(ctx context.Context, registry MetadatableRegistry, ids []*v1.UUID) ([]map[string]string, error) {
+	data := make([]map[string]string, len(ids))
+	tasks := make([]func() error, len(ids))
+	for i, id := range ids {
+		i, id := i, id
+		tasks[i] = func() (err error) {
+			data[i], err = fetchMetadata(ctx, registry, id)
+			if isNotFound(err) {
+				return nil // deleted in the meantime
+			}
+			return
+		}
+	}
+
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// formatMetadata formats a metadata map to a compact, sorted "key=value,key=value" string.
+func formatMetadata(data map[string]string) string {
+	pairs := make([]string, 0, len(data))
+	for _, key := range sortedKeys(data) {
+		pairs = append(pairs, key+"="+data[key])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// sortedKeys returns the keys of the supplied metadata map in ascending order.
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
 }
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testId is the UUID of the resource held by memoryRegistry in tests.
+const testId = "3f2a0c1e-8b9d-4e5f-a6b7-c8d9e0f1a2b3"
+
+// memoryRegistry is an in-memory MetadatableRegistry.
+type memoryRegistry struct {
+	mu   sync.Mutex
+	data map[string]map[string]string
+}
+
+func (r *memoryRegistry) GetMetadata(_ context.Context, in *v1.GetMetadataRequest, _ ...grpc.CallOption) (*v1.GetMetadataResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.data[in.GetId().GetValue()]
+	if !ok {
+		msg := "no such entity"
+		return &v1.GetMetadataResponse{MetadataOrError: &v1.GetMetadataResponse_Error{
+			Error: &v1.Error{Type: "NotFound", Msg: &msg},
+		}}, nil
+	}
+
+	copied := make(map[string]string, len(data))
+	for key, value := range data {
+		copied[key] = value
+	}
+	return &v1.GetMetadataResponse{MetadataOrError: &v1.GetMetadataResponse_Meta{Meta: &v1.MetadataMap{Data: copied}}}, nil
+}
+
+func (r *memoryRegistry) SetMetadata(_ context.Context, in *v1.SetMetadataRequest, _ ...grpc.CallOption) (*v1.SetMetadataResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data[in.GetId().GetValue()] = in.GetMeta().GetData()
+	return &v1.SetMetadataResponse{}, nil
+}
+
+// newMemoryRegistry creates a memoryRegistry holding a resource with the testId UUID and the supplied metadata.
+func newMemoryRegistry(data map[string]string) *memoryRegistry {
+	return &memoryRegistry{data: map[string]map[string]string{testId: data}}
+}
+
+// newTestResolver creates a Resolver of the supplied registry, resolving full UUIDs only.
+func newTestResolver(registry MetadatableRegistry) *Resolver {
+	return &Resolver{
+		noun: "virtual machine",
+		list: func(ctx context.Context) ([]*v1.UUID, error) {
+			return []*v1.UUID{{Value: testId}}, nil
+		},
+		registry: registry,
+	}
+}
+
+// runTestApp runs an app with the global flags clashing with command flags and the supplied commands.
+func runTestApp(t *testing.T, commands []*cli.Command, args ...string) error {
+	t.Helper()
+
+	app := &cli.App{
+		Name: "kitsh",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "key"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}},
+		},
+		Commands:       commands,
+		ExitErrHandler: func(*cli.Context, error) {}, // don't exit on KitshErrors
+	}
+	return app.Run(append([]string{"kitsh"}, args...))
+}
+
+func TestGetMetadataIgnoresGlobalKey(t *testing.T) {
+	registry := newMemoryRegistry(map[string]string{"env": "prod"})
+	action := GetMetadataFunc(registry, newTestResolver(registry))
+	commands := []*cli.Command{
+		{
+			Name:   "metadata",
+			Flags:  []cli.Flag{&cli.StringFlag{Name: "id"}},
+			Action: action,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "get",
+					Flags:  []cli.Flag{&cli.StringFlag{Name: "key", Aliases: []string{"k"}}},
+					Action: action,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"list with mTLS key", []string{"--key", "client.key", "metadata", "--id", testId}, 0},
+		{"get without key with mTLS key", []string{"--key", "client.key", "metadata", "--id", testId, "get"}, 0},
+		{"get key", []string{"--key", "client.key", "metadata", "--id", testId, "get", "--key", "env"}, 0},
+		{"get key alias", []string{"metadata", "--id", testId, "get", "-k", "env"}, 0},
+		{"get missing key", []string{"--key", "client.key", "metadata", "--id", testId, "get", "--key", "missing"}, ExitNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := ExitCode(runTestApp(t, commands, test.args...)); code != test.code {
+				t.Errorf("exit code = %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestSetMetadataKeepsProtection(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string
+		data     string
+		want     map[string]string
+	}{
+		{"unprotected", map[string]string{"a": "1"}, `{"b":"2"}`, map[string]string{"b": "2"}},
+		{"protected", map[string]string{"a": "1", ProtectedKey: "true"}, `{"b":"2"}`, map[string]string{"b": "2", ProtectedKey: "true"}},
+		{"protected empty", map[string]string{ProtectedKey: "true"}, `{}`, map[string]string{ProtectedKey: "true"}},
+		{"explicitly unprotected", map[string]string{ProtectedKey: "true"}, `{"kitsh.protected":"false"}`, map[string]string{ProtectedKey: "false"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newMemoryRegistry(test.existing)
+			commands := []*cli.Command{
+				{
+					Name: "set",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "id"},
+						&cli.StringFlag{Name: "data"},
+						&cli.StringSliceFlag{Name: "meta"},
+						&cli.StringSliceFlag{Name: "meta-file"},
+					},
+					Action: SetMetadataFunc(registry, newTestResolver(registry)),
+				},
+			}
+
+			if err := runTestApp(t, commands, "set", "--id", testId, "--data", test.data); err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			if got := registry.data[testId]; !equalMetadata(got, test.want) {
+				t.Errorf("metadata = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMetadataPatchApply(t *testing.T) {
+	value := func(s string) *string { return &s }
+
+	tests := []struct {
+		name  string
+		data  map[string]string
+		patch MetadataPatch
+		want  map[string]string
+	}{
+		{"set", map[string]string{"a": "1"}, MetadataPatch{"b": value("2")}, map[string]string{"a": "1", "b": "2"}},
+		{"replace", map[string]string{"a": "1"}, MetadataPatch{"a": value("2")}, map[string]string{"a": "2"}},
+		{"unset", map[string]string{"a": "1", "b": "2"}, MetadataPatch{"a": nil}, map[string]string{"b": "2"}},
+		{"unset missing", map[string]string{"a": "1"}, MetadataPatch{"b": nil}, map[string]string{"a": "1"}},
+		{"empty value", map[string]string{"a": "1"}, MetadataPatch{"a": value("")}, map[string]string{"a": ""}},
+		{"nil data", nil, MetadataPatch{"a": value("1")}, map[string]string{"a": "1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := make(map[string]string)
+			for key, value := range test.data {
+				original[key] = value
+			}
+
+			if got := test.patch.Apply(test.data); !equalMetadata(got, test.want) {
+				t.Errorf("Apply() = %v, want %v", got, test.want)
+			}
+			if test.data != nil && !equalMetadata(test.data, original) {
+				t.Errorf("Apply() modified its input to %v", test.data)
+			}
+		})
+	}
+}
+
+func TestMetadataErrorsAreKitshErrors(t *testing.T) {
+	registry := newMemoryRegistry(nil)
+	_, err := fetchMetadata(context.Background(), registry, &v1.UUID{Value: "missing"})
+
+	var kErr *KitshError
+	if !errors.As(err, &kErr) || kErr.Code != codes.NotFound {
+		t.Errorf("fetchMetadata() error = %v, want a NotFound KitshError", err)
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"plain", "A=1\nB=two words\n", map[string]string{"A": "1", "B": "two words"}, false},
+		{"blank lines and comments", "\n# comment\n  \nA=1\n", map[string]string{"A": "1"}, false},
+		{"export", "export A=1", map[string]string{"A": "1"}, false},
+		{"spaces", "  A = 1  ", map[string]string{"A": "1"}, false},
+		{"empty value", "A=", map[string]string{"A": ""}, false},
+		{"equals in value", "A=b=c", map[string]string{"A": "b=c"}, false},
+		{"double quotes", `A="line\nbreak # not a comment"`, map[string]string{"A": "line\nbreak # not a comment"}, false},
+		{"single quotes", `A='literal\n'`, map[string]string{"A": `literal\n`}, false},
+		{"single quote", `A="`, map[string]string{"A": `"`}, false},
+		{"later wins", "A=1\nA=2", map[string]string{"A": "2"}, false},
+		{"missing equals", "A", nil, true},
+		{"missing key", "=1", nil, true},
+		{"invalid double quotes", `A="\q"`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseDotenv("test.env", test.content)
+			if test.wantErr {
+				if !errors.Is(err, InvalidMetadata) {
+					t.Errorf("parseDotenv() error = %v, want %v", err, InvalidMetadata)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDotenv() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseDotenv() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMetadataFlags(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	yamlFile := write("meta.yaml", "b: yaml\nc: yaml\n")
+	envFile := write("meta.env", "c=env\nd=env\n")
+	valueFile := write("value.txt", "from file")
+	jsonFile := write("data.json", `{"a":"json file"}`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr error
+	}{
+		{"none", nil, map[string]string{}, nil},
+		{
+			"precedence",
+			[]string{
+				"--data", `{"a":"json","b":"json"}`, "--meta-file", yamlFile, "--meta-file", envFile,
+				"--meta", "d=flag", "--meta", "e=@" + valueFile,
+			},
+			map[string]string{"a": "json", "b": "yaml", "c": "env", "d": "flag", "e": "from file"},
+			nil,
+		},
+		{"data file", []string{"--data", "@" + jsonFile}, map[string]string{"a": "json file"}, nil},
+		{"null", []string{"--data", "null"}, map[string]string{}, nil},
+		{"equals in value", []string{"--meta", "a=b=c"}, map[string]string{"a": "b=c"}, nil},
+		{"empty value", []string{"--meta", "a="}, map[string]string{"a": ""}, nil},
+		{"not an object", []string{"--data", "[1]"}, nil, InvalidMetadata},
+		{"not strings", []string{"--data", `{"a":1}`}, nil, InvalidMetadata},
+		{"missing equals", []string{"--meta", "a"}, nil, InvalidMetadata},
+		{"missing key", []string{"--meta", "=a"}, nil, InvalidMetadata},
+		{"missing file", []string{"--meta", "a=@" + filepath.Join(dir, "missing")}, nil, os.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got map[string]string
+			commands := []*cli.Command{
+				{
+					Name: "create",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "data"},
+						&cli.StringSliceFlag{Name: "meta"},
+						&cli.StringSliceFlag{Name: "meta-file"},
+					},
+					Action: func(cCtx *cli.Context) (err error) {
+						got, err = metadataFlags(cCtx)
+						return
+					},
+				},
+			}
+
+			err := runTestApp(t, commands, append([]string{"create"}, test.args...)...)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("metadataFlags() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("metadataFlags() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("metadataFlags() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rodaine/table"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// OutputFormat is a format in which command results are rendered.
+type OutputFormat string
+
+const (
+	// OutputTable renders results as a human-readable table (the default).
+	OutputTable OutputFormat = "table"
+	// OutputWide renders results as a human-readable table with additional columns.
+	OutputWide OutputFormat = "wide"
+	// OutputJSON renders results as JSON, one document per line.
+	OutputJSON OutputFormat = "json"
+	// OutputYAML renders results as a stream of YAML documents.
+	OutputYAML OutputFormat = "yaml"
+	// OutputCSV renders results as CSV, including the header row and wide columns.
+	OutputCSV OutputFormat = "csv"
+	// OutputTemplate renders results with a user-supplied Go text/template, executed once per item.
+	OutputTemplate OutputFormat = "template"
+)
+
+// OutputFormats are all supported output formats.
+var OutputFormats = []OutputFormat{OutputTable, OutputWide, OutputJSON, OutputYAML, OutputCSV, OutputTemplate}
+
+// UnknownOutputFormat is an error about an unsupported output format.
+var UnknownOutputFormat = errors.New("unknown output format")
+
+// MissingTemplate is an error about the template output format being used without a template.
+var MissingTemplate = errors.New("missing template, use --output template=<template>")
+
+// Output is a command result, renderable as a table or as a sequence of machine-readable items of a single kind.
+type Output struct {
+	kind        Kind
+	headers     []string
+	wideHeaders []string
+	rows        [][]interface{}
+	items       []interface{}
+}
+
+// NewOutput creates an empty Output of the supplied kind with the supplied table headers.
+func NewOutput(kind Kind, headers ...string) *Output {
+	return &Output{kind: kind, headers: headers}
+}
+
+// WithWide adds headers of columns which are only shown in the "wide" and "csv" formats.
+func (o *Output) WithWide(headers ...string) *Output {
+	o.wideHeaders = append(o.wideHeaders, headers...)
+	return o
+}
+
+// Add adds an item along with its table row, wide cells trailing the regular ones.
+func (o *Output) Add(item interface{}, cells ...interface{}) {
+	o.AddItem(item)
+	o.AddRow(cells...)
+}
+
+// AddItem adds a machine-readable item without a corresponding table row.
+func (o *Output) AddItem(item interface{}) {
+	o.items = append(o.items, item)
+}
+
+// AddRow adds a table row without a corresponding machine-readable item.
+func (o *Output) AddRow(cells ...interface{}) {
+	o.rows = append(o.rows, cells)
+}
+
+// Render writes the Output to the app's writer (stdout) in the format selected by the "output" flag.
+func (o *Output) Render(cCtx *cli.Context) error {
+	format, tmpl, err := outputFormat(cCtx)
+	if err != nil {
+		return err
+	}
+
+	w := cCtx.App.Writer
+	switch format {
+	case OutputTable:
+		o.printTable(w, false)
+	case OutputWide:
+		o.printTable(w, true)
+	case OutputCSV:
+		return o.printCSV(w)
+	case OutputJSON:
+		return o.printJSON(w)
+	case OutputYAML:
+		return o.printYAML(w)
+	case OutputTemplate:
+		return o.printTemplate(w, tmpl)
+	}
+
+	return nil
+}
+
+// printTable prints the rows as a table, optionally including wide columns.
+func (o *Output) printTable(w io.Writer, wide bool) {
+	headers := o.headers
+	if wide {
+		headers = append(append([]string{}, o.headers...), o.wideHeaders...)
+	}
+
+	columns := make([]interface{}, len(headers))
+	for i, header := range headers {
+		columns[i] = header
+	}
+
+	tbl := table.New(columns...).WithWriter(w)
+	for _, row := range o.rows {
+		if len(row) > len(headers) {
+			row = row[:len(headers)]
+		}
+		tbl.AddRow(row...)
+	}
+	tbl.Print()
+}
+
+// printCSV prints the header and all rows, including wide columns, as CSV.
+func (o *Output) printCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append(append([]string{}, o.headers...), o.wideHeaders...)); err != nil {
+		return err
+	}
+
+	for _, row := range o.rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			record[i] = fmt.Sprint(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// printJSON prints every item as a single-line JSON document.
+func (o *Output) printJSON(w io.Writer) error {
+	for _, item := range o.items {
+		data, err := envelope(o.kind, item)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, string(data))
+	}
+
+	return nil
+}
+
+// printYAML prints every item as a separate YAML document.
+func (o *Output) printYAML(w io.Writer) error {
+	if len(o.items) == 0 {
+		return nil // closing an encoder without any documents fails
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, item := range o.items {
+		value, err := o.generic(item)
+		if err != nil {
+			return err
+		}
+
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+	}
+
+	return enc.Close()
+}
+
+// printTemplate executes the supplied template for every item, printing a newline after each one.
+func (o *Output) printTemplate(w io.Writer, text string) error {
+	tmpl, err := template.New("output").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range o.items {
+		value, err := o.generic(item)
+		if err != nil {
+			return err
+		}
+
+		if err := tmpl.Execute(w, value); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
+
+// generic converts the supplied item to the generic representation (maps, slices and scalars) of its envelope,
+// so that the YAML and template formats use the same schema as the JSON format.
+func (o *Output) generic(item interface{}) (interface{}, error) {
+	data, err := envelope(o.kind, item)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return unwrapNumbers(value), nil
+}
+
+// unwrapNumbers recursively replaces json.Number values with int64 or float64 values.
+func unwrapNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = unwrapNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = unwrapNumbers(e)
+		}
+	}
+
+	return v
+}
+
+// outputFormat resolves the output format and, if applicable, the template from the "output" flag.
+// The legacy "no-pretty" flag selects the JSON format if no explicit format is supplied,
+// otherwise the default output format of the selected context is used.
+func outputFormat(cCtx *cli.Context) (OutputFormat, string, error) {
+	value := cCtx.String("output")
+	if value == "" {
+		if cCtx.Bool("no-pretty") {
+			return OutputJSON, "", nil
+		}
+
+		ctx, err := selectedContext(cCtx)
+		if err != nil {
+			return "", "", err
+		}
+		if ctx == nil || ctx.Output == "" {
+			return OutputTable, "", nil
+		}
+		value = ctx.Output
+	}
+
+	return parseOutputFormat(value)
+}
+
+// parseOutputFormat parses an output format and, if applicable, the template from the supplied
+// "<format>[=<template>]" value.
+func parseOutputFormat(value string) (OutputFormat, string, error) {
+	name, tmpl, _ := strings.Cut(value, "=")
+	format := OutputFormat(strings.ToLower(name))
+	for _, f := range OutputFormats {
+		if f != format {
+			continue
+		}
+
+		if format == OutputTemplate && tmpl == "" {
+			return "", "", MissingTemplate
+		}
+		return format, tmpl, nil
+	}
+
+	return "", "", fmt.Errorf("%w: %s", UnknownOutputFormat, name)
+}
+
+// IsPrettyOutput checks whether the selected output format is meant for humans (a table format).
+func IsPrettyOutput(cCtx *cli.Context) bool {
+	format, _, err := outputFormat(cCtx)
+	return err != nil || format == OutputTable || format == OutputWide
+}
+
+// isWideOutput checks whether the "wide" output format is selected, or any format that includes wide columns.
+func isWideOutput(cCtx *cli.Context) bool {
+	format, _, _ := outputFormat(cCtx)
+	return format == OutputWide || format == OutputCSV
+}
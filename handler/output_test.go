@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"testing"
+)
+
+// renderTestOutput renders the supplied Output with the supplied "output" flag value and returns what was written.
+func renderTestOutput(t *testing.T, out *Output, format string) string {
+	t.Helper()
+
+	var stdout bytes.Buffer
+	app := &cli.App{
+		Name:   "kitsh",
+		Flags:  []cli.Flag{&cli.StringFlag{Name: "output", Aliases: []string{"o"}}},
+		Action: out.Render,
+		Writer: &stdout,
+	}
+	if err := app.Run([]string{"kitsh", "--output", format}); err != nil {
+		t.Fatalf("Render() = %v", err)
+	}
+
+	return stdout.String()
+}
+
+func TestOutputRender(t *testing.T) {
+	newOutput := func() *Output {
+		out := NewOutput(KindMetadata, "ID", "Name").WithWide("Metadata")
+		for _, item := range []Metadata{
+			{Id: &v1.UUID{Value: "00000000-0000-0000-0000-000000000001"}, Data: map[string]string{"name": "web", "note": `say "hi", then leave`}},
+			{Id: &v1.UUID{Value: "00000000-0000-0000-0000-000000000002"}, Data: map[string]string{"name": "db"}},
+		} {
+			out.Add(item, item.Id.GetValue(), item.Data["name"], formatMetadata(item.Data))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			"table",
+			"table",
+			"ID                                    Name  \n" +
+				"00000000-0000-0000-0000-000000000001  web   \n" +
+				"00000000-0000-0000-0000-000000000002  db    \n",
+		},
+		{
+			"wide",
+			"wide",
+			"ID                                    Name  Metadata                            \n" +
+				"00000000-0000-0000-0000-000000000001  web   name=web,note=say \"hi\", then leave  \n" +
+				"00000000-0000-0000-0000-000000000002  db    name=db                             \n",
+		},
+		{
+			"csv",
+			"csv",
+			"ID,Name,Metadata\n" +
+				"00000000-0000-0000-0000-000000000001,web,\"name=web,note=say \"\"hi\"\", then leave\"\n" +
+				"00000000-0000-0000-0000-000000000002,db,name=db\n",
+		},
+		{
+			"json",
+			"json",
+			`{"apiVersion":"kitsh/v1","data":{"name":"web","note":"say \"hi\", then leave"},"id":{"value":"00000000-0000-0000-0000-000000000001"},"kind":"Metadata"}` + "\n" +
+				`{"apiVersion":"kitsh/v1","data":{"name":"db"},"id":{"value":"00000000-0000-0000-0000-000000000002"},"kind":"Metadata"}` + "\n",
+		},
+		{
+			"yaml",
+			"yaml",
+			"apiVersion: kitsh/v1\n" +
+				"data:\n" +
+				"  name: web\n" +
+				"  note: say \"hi\", then leave\n" +
+				"id:\n" +
+				"  value: 00000000-0000-0000-0000-000000000001\n" +
+				"kind: Metadata\n" +
+				"---\n" +
+				"apiVersion: kitsh/v1\n" +
+				"data:\n" +
+				"  name: db\n" +
+				"id:\n" +
+				"  value: 00000000-0000-0000-0000-000000000002\n" +
+				"kind: Metadata\n",
+		},
+		{
+			"template",
+			"template={{.kind}} {{.id.value}} {{.data.name}} {{.data.missing}}",
+			"Metadata 00000000-0000-0000-0000-000000000001 web <no value>\n" +
+				"Metadata 00000000-0000-0000-0000-000000000002 db <no value>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := renderTestOutput(t, newOutput(), test.format); got != test.want {
+				t.Errorf("Render() wrote\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOutputRenderEmpty(t *testing.T) {
+	for _, format := range []string{"json", "yaml", "template={{.kind}}"} {
+		t.Run(format, func(t *testing.T) {
+			if got := renderTestOutput(t, NewOutput(KindMetadata, "ID"), format); got != "" {
+				t.Errorf("Render() wrote %q, want nothing", got)
+			}
+		})
+	}
+}
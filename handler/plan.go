@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"strings"
+)
+
+// Plan is a handler for the "plan" command, it exits with ExitDrift if kitsune doesn't match the manifests.
+func Plan(cCtx *cli.Context) error {
+	_, _, actions, err := planManifests(cCtx)
+	if err != nil {
+		return err
+	}
+
+	format, _, err := outputFormat(cCtx)
+	if err != nil {
+		return err
+	}
+
+	if format == OutputTable || format == OutputWide {
+		if len(actions) == 0 {
+			PrintSuccess("No changes, kitsune matches the manifests.\n")
+			return nil
+		}
+		printPlan(actions)
+	} else if err := renderActions(cCtx, actions); err != nil {
+		return err
+	}
+
+	if len(actions) == 0 {
+		return nil
+	}
+	return cli.Exit(fmt.Sprintf("kitsune differs from the manifests, %d changes planned", len(actions)), ExitDrift)
+}
+
+// printPlan prints the supplied actions as a colored, human-readable plan followed by a summary.
+func printPlan(actions []*Action) {
+	counts := make(map[Op]int)
+	for _, action := range actions {
+		counts[action.Op]++
+		noun := resourceNoun(action.Resource)
+
+		switch action.Op {
+		case OpCreate:
+			PrintSuccess("+ create %s %s (%s)\n", noun, action.Name, formatActionDetails(action))
+			printMetadataDiff("    ", nil, action.After)
+		case OpUpdate:
+			_, _ = WarningColor.Printf("~ update %s %s (%s)\n", noun, action.Name, action.Id.GetValue())
+			printMetadataDiff("    ", action.Before, action.After)
+		case OpAttach:
+			_, _ = WarningColor.Printf("~ attach image %s to %s %s\n", action.Image, noun, action.Name)
+		case OpDetach:
+			_, _ = WarningColor.Printf("~ detach image %s from %s %s\n", action.Image, noun, action.Name)
+		case OpDelete:
+			_, _ = ErrorColor.Printf("- delete %s %s (%s)\n", noun, action.Name, action.Id.GetValue())
+			for _, ref := range action.detach {
+				_, _ = WarningColor.Printf("    ~ detach image %s\n", ref)
+			}
+		}
+	}
+
+	summary := []string{
+		fmt.Sprintf("%d to create", counts[OpCreate]),
+		fmt.Sprintf("%d to update", counts[OpUpdate]),
+		fmt.Sprintf("%d to attach", counts[OpAttach]),
+		fmt.Sprintf("%d to detach", counts[OpDetach]),
+		fmt.Sprintf("%d to delete", counts[OpDelete]),
+	}
+	fmt.Printf("\nPlan: %s.\n", strings.Join(summary, ", "))
+}
+
+// resourceNoun gets the human-readable noun of the supplied resource kind.
+func resourceNoun(kind Kind) string {
+	if kind == KindVirtualMachine {
+		return "virtual machine"
+	}
+	return "image"
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// InvalidPollInterval is an error about a non-positive poll interval.
+var InvalidPollInterval = errors.New("the poll interval must be positive")
+
+// WaitTimedOut is an error about a virtual machine not reaching the expected power state in time.
+var WaitTimedOut = errors.New("timed out waiting for the virtual machine")
+
+// powerWait configures waiting for virtual machines to reach a power state, from the "poll-interval",
+// "wait-timeout" and "dry-run" flags.
+type powerWait struct {
+	interval time.Duration
+	timeout  time.Duration
+	// dryRun skips waiting, as the virtual machines never change their state in dry runs.
+	dryRun bool
+}
+
+// newPowerWait reads the powerWait of the supplied context.
+func newPowerWait(cCtx *cli.Context) (*powerWait, error) {
+	w := &powerWait{
+		interval: cCtx.Duration("poll-interval"),
+		timeout:  cCtx.Duration("wait-timeout"),
+		dryRun:   cCtx.Bool("dry-run"),
+	}
+	if w.interval <= 0 {
+		return nil, InvalidPollInterval
+	}
+
+	return w, nil
+}
+
+// until polls the liveness of the supplied virtual machine until it matches alive,
+// returning WaitTimedOut if it doesn't within timeout.
+func (w *powerWait) until(ctx context.Context, client *libkitsune.KitsuneClient, id *v1.UUID, alive bool, timeout time.Duration) error {
+	if w.dryRun {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := isAlive(ctx, client, id)
+		if err != nil {
+			return err
+		}
+		if current == alive {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf(
+				"%w: %s is still %s after %s",
+				WaitTimedOut, id.GetValue(), strings.ToLower(formatStatus(current)), timeout,
+			)
+		}
+		if !sleepContext(ctx, w.interval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// StopVirtualMachine is a handler for the "vm stop" command.
+func StopVirtualMachine(cCtx *cli.Context) error {
+	return powerCycle(cCtx, "stop", false)
+}
+
+// RestartVirtualMachine is a handler for the "vm restart" command.
+func RestartVirtualMachine(cCtx *cli.Context) error {
+	return powerCycle(cCtx, "restart", true)
+}
+
+// powerCycle stops the targeted virtual machines one after another, powering them on again if start is set.
+func powerCycle(cCtx *cli.Context, verb string, start bool) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	w, err := newPowerWait(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ids, err := newVmResolver(cCtx, client).Targets(cCtx)
+	if err != nil {
+		return err
+	}
+
+	if err := checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, verb, ids...); err != nil {
+		return err
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: verb, kind: KindVirtualMachine, ids: ids}); err != nil {
+		return err
+	}
+
+	return forEachTarget(ids, func(id *v1.UUID) error {
+		if err := stopGracefully(cCtx.Context, client, w, id, cCtx.Duration("grace")); err != nil {
+			return err
+		}
+		if !start {
+			return nil
+		}
+
+		if err := sendPowerAction(cCtx.Context, client, id, v1.PowerAction_POWERON); err != nil {
+			return err
+		}
+		return w.until(cCtx.Context, client, id, true, w.timeout)
+	})
+}
+
+// stopGracefully shuts the supplied virtual machine down via ACPI and powers it off if it is still running
+// after the grace period. Stopped virtual machines are left alone.
+func stopGracefully(ctx context.Context, client *libkitsune.KitsuneClient, w *powerWait, id *v1.UUID, grace time.Duration) error {
+	alive, err := isAlive(ctx, client, id)
+	if err != nil || !alive {
+		return err
+	}
+
+	if err := sendPowerAction(ctx, client, id, v1.PowerAction_POWERDOWN_ACPI); err != nil {
+		return err
+	}
+	err = w.until(ctx, client, id, false, grace)
+	if !errors.Is(err, WaitTimedOut) {
+		return err
+	}
+
+	_, _ = WarningColor.Fprintf(os.Stderr, "Virtual machine %s did not shut down within %s, powering it off.\n", id.GetValue(), grace)
+	if err := sendPowerAction(ctx, client, id, v1.PowerAction_POWERDOWN); err != nil {
+		return err
+	}
+	return w.until(ctx, client, id, false, w.timeout)
+}
+
+// powerActionState gets whether a virtual machine is expected to be running after the supplied power action.
+func powerActionState(action v1.PowerAction) bool {
+	return action == v1.PowerAction_POWERON || action == v1.PowerAction_RESET
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPowerWaitUntil(t *testing.T) {
+	tests := []struct {
+		name     string
+		alive    bool
+		stopping int
+		dryRun   bool
+		wantErr  error
+	}{
+		{name: "already stopped", alive: false, stopping: -1},
+		{name: "stops after polls", alive: true, stopping: 3},
+		{name: "never stops", alive: true, stopping: -1, wantErr: WaitTimedOut},
+		{name: "dry run", alive: true, stopping: -1, dryRun: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newFakeKitsune()
+			k.addVm("vm-a", test.alive, nil)
+			if test.stopping >= 0 {
+				k.stopping["vm-a"] = test.stopping
+			}
+			client := k.serve(t)
+
+			w := &powerWait{interval: time.Millisecond, timeout: 50 * time.Millisecond, dryRun: test.dryRun}
+			err := w.until(context.Background(), client, &v1.UUID{Value: "vm-a"}, false, w.timeout)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("until() = %v, want %v", err, test.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "vm-a is still running after 50ms") {
+				t.Errorf("until() = %v, want it to name the virtual machine, its status and the timeout", err)
+			}
+		})
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		client := newFakeKitsune().serve(t)
+
+		w := &powerWait{interval: time.Millisecond, timeout: 50 * time.Millisecond}
+		if err := w.until(context.Background(), client, &v1.UUID{Value: "vm-a"}, false, w.timeout); !isNotFound(err) {
+			t.Errorf("until() = %v, want a not found error", err)
+		}
+	})
+}
+
+func TestStopGracefully(t *testing.T) {
+	const (
+		acpi      = "SendPowerAction vm-a POWERDOWN_ACPI"
+		powerdown = "SendPowerAction vm-a POWERDOWN"
+	)
+
+	tests := []struct {
+		name           string
+		alive          bool
+		acpiPolls      int
+		powerdownPolls int
+		want           []string
+		wantErr        error
+	}{
+		{name: "stopped", alive: false},
+		{name: "acpi", alive: true, acpiPolls: 2, want: []string{acpi}},
+		{name: "acpi ignored", alive: true, acpiPolls: -1, powerdownPolls: 2, want: []string{acpi, powerdown}},
+		{name: "acpi too slow", alive: true, acpiPolls: 1000, powerdownPolls: 0, want: []string{acpi, powerdown}},
+		{name: "never stops", alive: true, acpiPolls: -1, powerdownPolls: -1, want: []string{acpi, powerdown}, wantErr: WaitTimedOut},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newFakeKitsune()
+			k.acpiPolls, k.powerdownPolls = test.acpiPolls, test.powerdownPolls
+			k.addVm("vm-a", test.alive, nil)
+			client := k.serve(t)
+
+			w := &powerWait{interval: time.Millisecond, timeout: 50 * time.Millisecond}
+			err := stopGracefully(context.Background(), client, w, &v1.UUID{Value: "vm-a"}, 20*time.Millisecond)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("stopGracefully() = %v, want %v", err, test.wantErr)
+			}
+
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			if !reflect.DeepEqual(k.calls, test.want) {
+				t.Errorf("calls = %q, want %q", k.calls, test.want)
+			}
+			if test.wantErr == nil && k.alive["vm-a"] {
+				t.Errorf("vm-a is still running")
+			}
+		})
+	}
+}
+
+func TestPowerWait(t *testing.T) {
+	tests := []struct {
+		name      string
+		global    []string
+		args      []string
+		dryRun    bool
+		acpiPolls int
+		wantErr   error
+	}{
+		{name: "no wait", args: []string{"--action", "powerdown_acpi"}, acpiPolls: -1},
+		{name: "wait", args: []string{"--action", "powerdown_acpi", "--wait"}, acpiPolls: 2},
+		{name: "wait expired", args: []string{"--action", "powerdown_acpi", "--wait"}, acpiPolls: -1, wantErr: WaitTimedOut},
+		{name: "wait dry run", global: []string{"--dry-run"}, dryRun: true, args: []string{"--action", "powerdown_acpi", "--wait"}, acpiPolls: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newFakeKitsune()
+			k.acpiPolls = test.acpiPolls
+			k.addVm(testId, true, map[string]string{"name": "web"})
+			target := k.start(t)
+
+			app := &cli.App{
+				Name: "kitsh",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "config", Value: filepath.Join(t.TempDir(), "config.yaml")},
+					&cli.StringFlag{Name: "target", Value: target},
+					&cli.DurationFlag{Name: "timeout", Value: 5 * time.Second},
+					&cli.StringFlag{Name: "name-key", Value: "name"},
+					&cli.BoolFlag{Name: "dry-run"},
+				},
+				Commands: []*cli.Command{
+					{
+						Name: "power",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "id", Value: "web"},
+							&cli.StringFlag{Name: "selector"},
+							&cli.StringFlag{Name: "action"},
+							&cli.BoolFlag{Name: "wait"},
+							&cli.DurationFlag{Name: "poll-interval", Value: time.Millisecond},
+							&cli.DurationFlag{Name: "wait-timeout", Value: 50 * time.Millisecond},
+							&cli.BoolFlag{Name: "yes"},
+						},
+						Action: Power,
+					},
+				},
+				ExitErrHandler: func(*cli.Context, error) {},
+			}
+
+			args := append(append(append([]string{"kitsh"}, test.global...), "power"), test.args...)
+			if err := app.Run(args); !errors.Is(err, test.wantErr) {
+				t.Fatalf("Power() = %v, want %v", err, test.wantErr)
+			}
+
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			want := []string{"SendPowerAction " + testId + " POWERDOWN_ACPI"}
+			if test.dryRun {
+				want = nil
+			}
+			if !reflect.DeepEqual(k.calls, want) {
+				t.Errorf("calls = %q, want %q", k.calls, want)
+			}
+		})
+	}
+}
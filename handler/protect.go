@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"strconv"
+)
+
+// ProtectedKey is the metadata key protecting virtual machines and images from being deleted, detached,
+// having their metadata cleared or being powered off and reset by kitsh, if set to "true".
+const ProtectedKey = "kitsh.protected"
+
+// ProtectedError is returned for operations refused because a virtual machine or image is protected.
+type ProtectedError struct {
+	// Kind is the kind of the protected resource.
+	Kind Kind
+	// Id is the UUID of the protected resource.
+	Id *v1.UUID
+	// Op is the refused operation, e.g. "delete".
+	Op string
+}
+
+// Error describes the refused operation and how to allow it.
+func (e *ProtectedError) Error() string {
+	command := "vm"
+	if e.Kind == KindImage {
+		command = "image"
+	}
+	return fmt.Sprintf(
+		"refusing to %s protected %s %s, remove the protection with 'kitsh %s unprotect' first",
+		e.Op, resourceNoun(e.Kind), e.Id.GetValue(), command,
+	)
+}
+
+// ExitCode gets the exit code of the error, it implements cli.ExitCoder.
+func (e *ProtectedError) ExitCode() int {
+	return ExitProtected
+}
+
+// isProtected checks whether the supplied metadata marks its resource as protected.
+func isProtected(data map[string]string) bool {
+	protected, _ := strconv.ParseBool(data[ProtectedKey])
+	return protected
+}
+
+// checkProtected returns a ProtectedError if any of the supplied resources is protected,
+// fetching their metadata concurrently. Resources deleted in the meantime are ignored.
+func checkProtected(ctx context.Context, registry MetadatableRegistry, kind Kind, op string, ids ...*v1.UUID) error {
+	protected := make([]bool, len(ids))
+	tasks := make([]func() error, len(ids))
+	for i, id := range ids {
+		i, id := i, id
+		tasks[i] = func() error {
+			data, err := fetchMetadata(ctx, registry, id)
+			if isNotFound(err) {
+				return nil // deleted in the meantime
+			}
+			if err != nil {
+				return err
+			}
+
+			protected[i] = isProtected(data)
+			return nil
+		}
+	}
+	if err := runConcurrentlyLimit(resolveConcurrency, tasks...); err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if protected[i] {
+			return &ProtectedError{Kind: kind, Id: id, Op: op}
+		}
+	}
+	return nil
+}
+
+// ProtectFunc produces a handler for "protect" and "unprotect" commands, resolving the "id" or "selector" flag
+// with the supplied Resolver.
+func ProtectFunc(registry MetadatableRegistry, resolver *Resolver, protect bool) func(cCtx *cli.Context) error {
+	return func(cCtx *cli.Context) error {
+		ids, err := resolver.Targets(cCtx)
+		if err != nil {
+			return err
+		}
+
+		return forEachTarget(ids, func(id *v1.UUID) error {
+			return updateMetadata(cCtx.Context, registry, id, func(data map[string]string) (map[string]string, error) {
+				updated := make(map[string]string, len(data)+1)
+				for key, value := range data {
+					updated[key] = value
+				}
+
+				if protect {
+					updated[ProtectedKey] = "true"
+				} else {
+					delete(updated, ProtectedKey)
+				}
+				return updated, nil
+			})
+		})
+	}
+}
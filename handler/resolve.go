@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/lusory/libkitsune"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"sort"
+	"strings"
+)
+
+// resolveConcurrency is the maximum number of metadata requests issued concurrently while resolving names.
+const resolveConcurrency = 8
+
+// Resolver resolves references to virtual machines or images, which are either full UUIDs, names stored in
+// a metadata key or UUID prefixes. Full UUIDs take precedence, names and UUID prefixes must match a single
+// entity together.
+type Resolver struct {
+	// noun is the name of the resolved entity in errors.
+	noun string
+	// list lists the IDs of all entities in the registry.
+	list func(ctx context.Context) ([]*v1.UUID, error)
+	// registry is the registry holding the metadata of the entities.
+	registry MetadatableRegistry
+	// nameKey is the metadata key holding names, names aren't resolved if it is empty.
+	nameKey string
+}
+
+// newVmResolver creates a Resolver for virtual machines.
+func newVmResolver(cCtx *cli.Context, client *libkitsune.KitsuneClient) *Resolver {
+	return &Resolver{
+		noun: "virtual machine",
+		list: func(ctx context.Context) ([]*v1.UUID, error) {
+			vms, err := client.VmRegistry.GetVirtualMachines(ctx, &emptypb.Empty{})
+			if err != nil {
+				return nil, err
+			}
+
+			var ids []*v1.UUID
+			err = forEachVms(vms, func(vm *v1.VirtualMachine) error {
+				ids = append(ids, vm.GetId())
+				return nil
+			})
+			return ids, err
+		},
+		registry: client.VmRegistry,
+		nameKey:  cCtx.String("name-key"),
+	}
+}
+
+// newImageResolver creates a Resolver for images.
+func newImageResolver(cCtx *cli.Context, client *libkitsune.KitsuneClient) *Resolver {
+	return &Resolver{
+		noun: "image",
+		list: func(ctx context.Context) ([]*v1.UUID, error) {
+			images, err := client.ImageRegistry.GetImages(ctx, &emptypb.Empty{})
+			if err != nil {
+				return nil, err
+			}
+
+			var ids []*v1.UUID
+			err = forEachImages(images, func(image *v1.Image) error {
+				ids = append(ids, image.GetId())
+				return nil
+			})
+			return ids, err
+		},
+		registry: client.ImageRegistry,
+		nameKey:  cCtx.String("name-key"),
+	}
+}
+
+// Resolve resolves the supplied reference to an ID, failing with a NotFound KitshError if nothing matches
+// and with an InvalidArgument KitshError if the reference is ambiguous, including a name of one entity
+// being a UUID prefix of another. Full UUIDs are returned as-is, without checking whether they exist.
+func (r *Resolver) Resolve(ctx context.Context, ref string) (*v1.UUID, error) {
+	if id, err := uuid.Parse(ref); err == nil {
+		return &v1.UUID{Value: id.String()}, nil
+	}
+	if ref == "" {
+		return nil, &KitshError{Code: codes.InvalidArgument, Msg: fmt.Sprintf("missing %s reference", r.noun)}
+	}
+
+	ids, err := r.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := r.findNamed(ctx, ids, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.ToLower(ref)
+	for _, id := range ids {
+		if strings.HasPrefix(id.GetValue(), prefix) && !containsId(candidates, id) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	return r.unique(ref, candidates)
+}
+
+// findNamed finds the IDs among the supplied ones whose name is the supplied one.
+func (r *Resolver) findNamed(ctx context.Context, ids []*v1.UUID, name string) ([]*v1.UUID, error) {
+	if r.nameKey == "" {
+		return nil, nil
+	}
+
+	return r.filter(ctx, ids, func(data map[string]string) bool {
+		return data[r.nameKey] == name
+	})
+}
+
+// filter finds the IDs among the supplied ones whose metadata matches, fetching the metadata concurrently.
+// Entities deleted in the meantime don't match.
+func (r *Resolver) filter(ctx context.Context, ids []*v1.UUID, match func(data map[string]string) bool) ([]*v1.UUID, error) {
+	data, err := fetchAllMetadata(ctx, r.registry, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*v1.UUID, 0)
+	for i, id := range ids {
+		if data[i] != nil && match(data[i]) {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered, nil
+}
+
+// unique returns the only supplied candidate, failing if there are none or more than one.
+func (r *Resolver) unique(ref string, candidates []*v1.UUID) (*v1.UUID, error) {
+	switch len(candidates) {
+	case 0:
+		return nil, &KitshError{Code: codes.NotFound, Msg: fmt.Sprintf("no %s matches %s", r.noun, ref)}
+	case 1:
+		return candidates[0], nil
+	}
+
+	values := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		values[i] = candidate.GetValue()
+	}
+	sort.Strings(values)
+
+	return nil, &KitshError{
+		Code: codes.InvalidArgument,
+		Msg:  fmt.Sprintf("%s %s is ambiguous, it matches %s", r.noun, ref, strings.Join(values, ", ")),
+	}
+}
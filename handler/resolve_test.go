@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"sort"
+	"testing"
+)
+
+// newMemoryResolver creates a Resolver listing all entities of the supplied registry.
+func newMemoryResolver(registry *memoryRegistry, nameKey string) *Resolver {
+	return &Resolver{
+		noun: "virtual machine",
+		list: func(ctx context.Context) ([]*v1.UUID, error) {
+			var ids []*v1.UUID
+			for id := range registry.data {
+				ids = append(ids, &v1.UUID{Value: id})
+			}
+			sort.Slice(ids, func(i, j int) bool {
+				return ids[i].GetValue() < ids[j].GetValue()
+			})
+			return ids, nil
+		},
+		registry: registry,
+		nameKey:  nameKey,
+	}
+}
+
+func TestResolve(t *testing.T) {
+	const (
+		web     = "3f2a0c1e-8b9d-4e5f-a6b7-c8d9e0f1a2b3"
+		db      = "3f2b1d2f-9cae-4f60-b7c8-d9eaf1a2b3c4"
+		shadow  = "abcd2e3f-adbf-4071-88d9-eafb02b3c4d5"
+		beef    = "beef3f4a-bec0-4182-99ea-fb0c13c4d5e6"
+		dupOne  = "c0de4a5b-cfd1-4293-aafb-0c1d24d5e6f7"
+		dupTwo  = "c1de5b6c-d0e2-43a4-bb0c-1d2e35e6f708"
+		missing = "00000000-0000-4000-8000-000000000000"
+	)
+	registry := &memoryRegistry{data: map[string]map[string]string{
+		web:    {"name": "web"},
+		db:     {"name": "db"},
+		shadow: {"name": "3f2a"},
+		beef:   {"name": "beef"},
+		dupOne: {"name": "dup"},
+		dupTwo: {"name": "dup"},
+	}}
+
+	tests := []struct {
+		ref     string
+		nameKey string
+		want    string
+		code    int
+	}{
+		{web, "name", web, 0},
+		{"3F2A0C1E-8B9D-4E5F-A6B7-C8D9E0F1A2B3", "name", web, 0},
+		{missing, "name", missing, 0},
+		{"web", "name", web, 0},
+		{"3f2b", "name", db, 0},
+		{"3F2B", "name", db, 0},
+		{"beef", "name", beef, 0},
+		{"3f2", "name", "", ExitInvalidArgument},
+		{"3f2a", "name", "", ExitInvalidArgument},
+		{"3f2a", "", web, 0},
+		{"dup", "name", "", ExitInvalidArgument},
+		{"web", "", "", ExitNotFound},
+		{"nothing", "name", "", ExitNotFound},
+		{"", "name", "", ExitInvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.ref+" "+test.nameKey, func(t *testing.T) {
+			id, err := newMemoryResolver(registry, test.nameKey).Resolve(context.Background(), test.ref)
+			if code := ExitCode(err); code != test.code {
+				t.Fatalf("Resolve() error = %v, want exit code %d", err, test.code)
+			}
+			if id.GetValue() != test.want {
+				t.Errorf("Resolve() = %s, want %s", id.GetValue(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff is the upper bound of the delay between two attempts of a call.
+const maxRetryBackoff = 30 * time.Second
+
+// idempotent checks whether the supplied full gRPC method name (/package.Service/Method) is safe to retry,
+// i.e. it only reads state.
+func idempotent(method string) bool {
+	name := path.Base(method)
+	return strings.HasPrefix(name, "Get") || strings.HasPrefix(name, "Find") || name == "IsAlive"
+}
+
+// retryable checks whether the supplied error of an attempt is transient.
+// Exceeded deadlines are only considered transient if the deadline was the one of the attempt, not of the call.
+func retryable(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return ctx.Err() == nil
+	}
+	return false
+}
+
+// retryDelay computes the delay before the supplied (zero-based) retry, doubling the base backoff for every retry
+// and adding up to 50% of jitter.
+func retryDelay(backoff time.Duration, retry int) time.Duration {
+	delay := backoff
+	for i := 0; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	if delay > 0 {
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	}
+	return delay
+}
+
+// sleepContext waits for the supplied duration, returning false if ctx is done before that.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryUnaryInterceptor produces an interceptor which retries idempotent unary calls failing with transient errors
+// up to the supplied number of times, waiting with an exponential backoff between attempts.
+func retryUnaryInterceptor(retries int, backoff time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if !idempotent(method) {
+			return err
+		}
+
+		for retry := 0; retry < retries && retryable(ctx, err); retry++ {
+			if !sleepContext(ctx, retryDelay(backoff, retry)) {
+				break
+			}
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		return err
+	}
+}
+
+// retryStreamInterceptor produces an interceptor which re-establishes idempotent streams failing with transient
+// errors before receiving their first message up to the supplied number of times, waiting with an exponential backoff
+// between attempts.
+func retryStreamInterceptor(retries int, backoff time.Duration) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if !idempotent(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		retry := 0
+		return newReplayingStream(ctx, desc, cc, method, streamer, opts, func(err error) bool {
+			if retry >= retries || !retryable(ctx, err) {
+				return false
+			}
+
+			delay := retryDelay(backoff, retry)
+			retry++
+			return sleepContext(ctx, delay)
+		})
+	}
+}
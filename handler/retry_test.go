@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{"/kitsune.proto.v1.ImageRegistryService/GetImages", true},
+		{"/kitsune.proto.v1.ImageRegistryService/GetMetadata", true},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/GetAttachedImages", true},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/FindVirtualMachines", true},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/IsAlive", true},
+		{"/kitsune.proto.v1.ImageRegistryService/CreateImage", false},
+		{"/kitsune.proto.v1.ImageRegistryService/SetMetadata", false},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/SendPowerAction", false},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/AttachImage", false},
+		{"/kitsune.proto.v1.VirtualMachineRegistryService/DeleteVirtualMachine", false},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			if got := idempotent(test.method); got != test.want {
+				t.Errorf("idempotent() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		retry   int
+		min     time.Duration
+	}{
+		{0, 0, 0},
+		{0, 5, 0},
+		{250 * time.Millisecond, 0, 250 * time.Millisecond},
+		{250 * time.Millisecond, 1, 500 * time.Millisecond},
+		{250 * time.Millisecond, 3, 2 * time.Second},
+		{250 * time.Millisecond, 20, maxRetryBackoff},
+		{time.Minute, 0, maxRetryBackoff},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			// up to 50% of jitter
+			if got := retryDelay(test.backoff, test.retry); got < test.min || got > test.min*3/2 {
+				t.Fatalf("retryDelay(%s, %d) = %s, want between %s and %s", test.backoff, test.retry, got, test.min, test.min*3/2)
+			}
+		}
+	}
+}
+
+func TestRetryUnaryInterceptor(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		errs     []codes.Code
+		attempts int
+		want     codes.Code
+	}{
+		{"success", context.Background(), "/s/GetImages", nil, 1, codes.OK},
+		{"transient", context.Background(), "/s/GetImages", []codes.Code{codes.Unavailable, codes.DeadlineExceeded}, 3, codes.OK},
+		{"exhausted", context.Background(), "/s/IsAlive", []codes.Code{codes.Unavailable, codes.Unavailable, codes.Unavailable, codes.Unavailable}, 3, codes.Unavailable},
+		{"permanent", context.Background(), "/s/GetImages", []codes.Code{codes.NotFound}, 1, codes.NotFound},
+		{"not idempotent", context.Background(), "/s/CreateImage", []codes.Code{codes.Unavailable}, 1, codes.Unavailable},
+		{"canceled", canceled, "/s/GetImages", []codes.Code{codes.DeadlineExceeded}, 1, codes.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return status.Error(test.errs[attempts-1], "failed")
+				}
+				return nil
+			}
+
+			err := retryUnaryInterceptor(2, time.Millisecond)(test.ctx, test.method, nil, nil, nil, invoker)
+			if code := status.Code(err); code != test.want {
+				t.Errorf("interceptor error = %v, want %s", err, test.want)
+			}
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
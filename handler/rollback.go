@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// rollback records how to undo the steps of a multi-step operation, so that a failed operation
+// leaves nothing behind.
+type rollback struct {
+	steps []rollbackStep
+}
+
+// rollbackStep is a single undoable step of a rollback.
+type rollbackStep struct {
+	desc string
+	undo func(ctx context.Context) error
+}
+
+// add records how to undo a completed step, desc describes the undo for error messages (e.g. "delete image X").
+func (r *rollback) add(desc string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{desc: desc, undo: undo})
+}
+
+// run undoes all recorded steps in reverse order and returns cause, annotated with the steps that failed
+// to be undone. A fresh context is used, so that the rollback still runs if the operation was cancelled.
+func (r *rollback) run(cause error) error {
+	var failed []string
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if err := r.steps[i].undo(context.Background()); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.steps[i].desc, err))
+		}
+	}
+	r.steps = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w (rollback failed, clean up manually: %s)", cause, strings.Join(failed, "; "))
+	}
+	return fmt.Errorf("%w (rolled back)", cause)
+}
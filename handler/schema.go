@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// APIVersion is the version of the machine-readable output schema, it is bumped on every breaking change.
+const APIVersion = "kitsh/v1"
+
+// Kind is a kind of machine-readable output item, every item is wrapped in an envelope carrying its kind.
+type Kind string
+
+const (
+	// KindVirtualMachine is a kitsune.proto.v1.VirtualMachine.
+	KindVirtualMachine Kind = "VirtualMachine"
+	// KindImage is a kitsune.proto.v1.Image.
+	KindImage Kind = "Image"
+	// KindVirtualMachineStatus is a VirtualMachineStatus.
+	KindVirtualMachineStatus Kind = "VirtualMachineStatus"
+	// KindAttachedImages is an AttachedImages.
+	KindAttachedImages Kind = "AttachedImages"
+	// KindMetadata is a Metadata.
+	KindMetadata Kind = "Metadata"
+	// KindContext is a ConfigContext.
+	KindContext Kind = "Context"
+	// KindVirtualMachineDescription is a VirtualMachineDescription.
+	KindVirtualMachineDescription Kind = "VirtualMachineDescription"
+	// KindImageDescription is an ImageDescription.
+	KindImageDescription Kind = "ImageDescription"
+	// KindAction is an Action of "kitsh apply".
+	KindAction Kind = "Action"
+	// KindError is an ErrorReport, printed to stderr.
+	KindError Kind = "Error"
+)
+
+// UnknownKind is an error about an unknown output kind.
+var UnknownKind = errors.New("unknown kind")
+
+// VirtualMachineStatus is the status of a virtual machine.
+type VirtualMachineStatus struct {
+	Id    *v1.UUID `json:"id"`
+	Alive bool     `json:"alive"`
+}
+
+// AttachedImages is a list of images attached to a virtual machine.
+type AttachedImages struct {
+	Id     *v1.UUID   `json:"id"`
+	Images []*v1.UUID `json:"images"`
+}
+
+// Metadata is the metadata of a virtual machine or an image.
+type Metadata struct {
+	Id   *v1.UUID          `json:"id"`
+	Data map[string]string `json:"data"`
+}
+
+// VirtualMachineDescription is an aggregated view of a virtual machine.
+type VirtualMachineDescription struct {
+	Machine    *v1.VirtualMachine `json:"machine"`
+	Alive      bool               `json:"alive"`
+	Images     []*v1.Image        `json:"images"`
+	Metadata   map[string]string  `json:"metadata"`
+	VNCServers []*v1.VNCServer    `json:"vncServers"`
+}
+
+// ImageDescription is an aggregated view of an image, including the virtual machines it is attached to.
+type ImageDescription struct {
+	Image      *v1.Image         `json:"image"`
+	Metadata   map[string]string `json:"metadata"`
+	AttachedTo []*v1.UUID        `json:"attachedTo"`
+}
+
+// kinds maps every output kind to a zero value of the Go type backing it.
+var kinds = map[Kind]interface{}{
+	KindVirtualMachine:            (*v1.VirtualMachine)(nil),
+	KindImage:                     (*v1.Image)(nil),
+	KindVirtualMachineStatus:      VirtualMachineStatus{},
+	KindAttachedImages:            AttachedImages{},
+	KindMetadata:                  Metadata{},
+	KindContext:                   ConfigContext{},
+	KindVirtualMachineDescription: VirtualMachineDescription{},
+	KindImageDescription:          ImageDescription{},
+	KindAction:                    Action{},
+	KindError:                     ErrorReport{},
+}
+
+// protojsonOptions are the options used for marshalling protobuf messages in machine-readable output.
+var protojsonOptions = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// Schema is a handler for the "schema" command.
+func Schema(cCtx *cli.Context) error {
+	names := cCtx.Args().Slice()
+	if len(names) == 0 {
+		for kind := range kinds {
+			names = append(names, string(kind))
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		schema, err := kindSchema(Kind(name))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+
+	return nil
+}
+
+// envelope marshals the supplied item of the supplied kind to a versioned JSON document,
+// the item's fields are merged with the "apiVersion" and "kind" fields.
+func envelope(kind Kind, item interface{}) ([]byte, error) {
+	data, err := marshalJSON(reflect.ValueOf(item))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%s is not an object: %w", kind, err)
+	}
+
+	fields["apiVersion"], _ = json.Marshal(APIVersion)
+	fields["kind"], _ = json.Marshal(kind)
+
+	return json.Marshal(fields)
+}
+
+// marshalJSON marshals the supplied value to JSON, using protojson for all nested protobuf messages.
+func marshalJSON(v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return []byte("null"), nil
+	}
+	if msg, ok := v.Interface().(proto.Message); ok {
+		return protojsonOptions.Marshal(msg)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		return marshalJSON(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]json.RawMessage)
+		for i := 0; i < v.NumField(); i++ {
+			name, omitEmpty, ok := jsonField(v.Type().Field(i))
+			if !ok || (omitEmpty && v.Field(i).IsZero()) {
+				continue
+			}
+
+			data, err := marshalJSON(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = data
+		}
+		return json.Marshal(fields)
+	case reflect.Slice, reflect.Array:
+		elems := make([]json.RawMessage, v.Len())
+		for i := range elems {
+			data, err := marshalJSON(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = data
+		}
+		return json.Marshal(elems)
+	case reflect.Map:
+		entries := make(map[string]json.RawMessage, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			data, err := marshalJSON(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			entries[fmt.Sprint(iter.Key().Interface())] = data
+		}
+		return json.Marshal(entries)
+	}
+
+	return json.Marshal(v.Interface())
+}
+
+// jsonField gets the JSON name of the supplied struct field and whether it should be omitted if empty,
+// ok is false if the field should be skipped entirely.
+func jsonField(field reflect.StructField) (name string, omitEmpty bool, ok bool) {
+	if !field.IsExported() {
+		return "", false, false
+	}
+
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+
+	return name, opts == "omitempty", true
+}
+
+// kindSchema generates the JSON Schema of the supplied output kind.
+func kindSchema(kind Kind) (map[string]interface{}, error) {
+	value, ok := kinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", UnknownKind, kind)
+	}
+
+	defs := make(map[string]interface{})
+	schema := typeSchema(reflect.TypeOf(value), defs)
+
+	// inline the top-level message, so that its fields are merged with the envelope fields
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/$defs/")
+		schema = defs[name].(map[string]interface{})
+		delete(defs, name)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	properties["apiVersion"] = map[string]interface{}{"const": APIVersion}
+	properties["kind"] = map[string]interface{}{"const": string(kind)}
+	schema["required"] = append(schema["required"].([]string), "apiVersion", "kind")
+	sort.Strings(schema["required"].([]string))
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = APIVersion + "/" + string(kind)
+	schema["title"] = string(kind)
+	if len(defs) > 0 {
+		schema["$defs"] = defs
+	}
+
+	return schema, nil
+}
+
+// protoMessageType is the reflect.Type of proto.Message.
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// typeSchema generates the JSON Schema of the supplied Go type, as marshalled by marshalJSON.
+// Protobuf messages are put into defs and referenced.
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t.Implements(protoMessageType) {
+		msg := reflect.Zero(t).Interface().(proto.Message)
+		return messageSchema(msg.ProtoReflect().Descriptor(), defs)
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			name, omitEmpty, ok := jsonField(t.Field(i))
+			if !ok {
+				continue
+			}
+
+			properties[name] = typeSchema(t.Field(i).Type, defs)
+			if !omitEmpty {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	}
+
+	return map[string]interface{}{}
+}
+
+// messageSchema puts the JSON Schema of the supplied protobuf message, as marshalled by protojson, into defs
+// and returns a reference to it.
+func messageSchema(desc protoreflect.MessageDescriptor, defs map[string]interface{}) map[string]interface{} {
+	name := string(desc.FullName())
+	ref := map[string]interface{}{"$ref": "#/$defs/" + name}
+	if _, ok := defs[name]; ok {
+		return ref
+	}
+
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	// register before descending, so that recursive messages terminate
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	defs[name] = schema
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		properties[field.JSONName()] = fieldSchema(field, defs)
+		// oneof members (including proto3 optional fields) are omitted when unset, even with EmitUnpopulated
+		if field.ContainingOneof() == nil {
+			required = append(required, field.JSONName())
+		}
+	}
+	schema["required"] = required
+
+	return ref
+}
+
+// fieldSchema generates the JSON Schema of the supplied protobuf field, as marshalled by protojson.
+func fieldSchema(field protoreflect.FieldDescriptor, defs map[string]interface{}) map[string]interface{} {
+	switch {
+	case field.IsMap():
+		return map[string]interface{}{"type": "object", "additionalProperties": singularSchema(field.MapValue(), defs)}
+	case field.IsList():
+		return map[string]interface{}{"type": "array", "items": singularSchema(field, defs)}
+	case field.Message() != nil:
+		// unset message fields are emitted as null
+		return map[string]interface{}{"anyOf": []interface{}{singularSchema(field, defs), map[string]interface{}{"type": "null"}}}
+	}
+
+	return singularSchema(field, defs)
+}
+
+// singularSchema generates the JSON Schema of a single value of the supplied protobuf field.
+func singularSchema(field protoreflect.FieldDescriptor, defs map[string]interface{}) map[string]interface{} {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return map[string]interface{}{"type": "boolean"}
+	case protoreflect.StringKind:
+		return map[string]interface{}{"type": "string"}
+	case protoreflect.BytesKind:
+		return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return map[string]interface{}{"type": "integer"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// protojson encodes 64-bit integers as strings
+		return map[string]interface{}{"type": "string", "pattern": "^-?[0-9]+$"}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return map[string]interface{}{"type": "number"}
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		names := make([]string, values.Len())
+		for i := range names {
+			names[i] = string(values.Get(i).Name())
+		}
+		return map[string]interface{}{"type": "string", "enum": names}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return messageSchema(field.Message(), defs)
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// validate validates the supplied decoded JSON value against the supplied schema, as generated by kindSchema.
+// Only the keywords used by kindSchema are supported.
+func validate(schema map[string]interface{}, defs map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, ok := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unresolvable reference %s", path, ref)
+		}
+		return validate(def, defs, value, path)
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var errs []string
+		for _, sub := range anyOf {
+			err := validate(sub.(map[string]interface{}), defs, value, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: no schema of anyOf matches: %s", path, strings.Join(errs, "; "))
+	}
+	if constant, ok := schema["const"]; ok && value != constant {
+		return fmt.Errorf("%s: %v is not %v", path, value, constant)
+	}
+	if enum, ok := schema["enum"].([]string); ok && !containsString(enum, fmt.Sprint(value)) {
+		return fmt.Errorf("%s: %v is none of %v", path, value, enum)
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("%s: %v doesn't match %s", path, value, pattern)
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", path, value)
+		}
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", path, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range object {
+			sub, ok := properties[name].(map[string]interface{})
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unexpected property %s", path, name)
+					}
+					continue
+				case map[string]interface{}:
+					sub = additional
+				default:
+					continue
+				}
+			}
+			if err := validate(sub, defs, property, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", path, value)
+		}
+		for i, elem := range array {
+			if err := validate(schema["items"].(map[string]interface{}), defs, elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", path, value)
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return fmt.Errorf("%s: %v is not a number", path, value)
+		}
+	case "integer":
+		if n, ok := value.(json.Number); !ok || strings.ContainsAny(n.String(), ".eE") {
+			return fmt.Errorf("%s: %v is not an integer", path, value)
+		}
+	case "null":
+		if value != nil {
+			return fmt.Errorf("%s: %v is not null", path, value)
+		}
+	}
+
+	return nil
+}
+
+// decodeJSON decodes the supplied JSON document to generic values, keeping numbers as json.Number.
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestEnvelopeMatchesSchema(t *testing.T) {
+	id := &v1.UUID{Value: testId}
+	display := ":1"
+	vm := &v1.VirtualMachine{Id: id, Arch: v1.Architecture_X86_64, MemorySize: 1 << 32}
+	image := &v1.Image{Id: id, Format: v1.Image_QCOW2, Size: 1 << 40, ReadOnly: true, MediaType: v1.Image_DISK}
+
+	// populated items besides the zero values, so that every field is checked
+	items := map[Kind]interface{}{
+		KindVirtualMachine:       vm,
+		KindImage:                image,
+		KindVirtualMachineStatus: VirtualMachineStatus{Id: id, Alive: true},
+		KindAttachedImages:       AttachedImages{Id: id, Images: []*v1.UUID{id}},
+		KindMetadata:             Metadata{Id: id, Data: map[string]string{"name": "web"}},
+		KindContext: ConfigContext{
+			Name:    "prod",
+			Target:  "kitsune:8080",
+			TLS:     &TLSConfig{Enabled: true, CAFile: "ca.pem", InsecureSkipVerify: true},
+			Auth:    &AuthConfig{TokenFile: "token", AllowInsecure: true},
+			Output:  "json",
+			Timeout: "10s",
+		},
+		KindVirtualMachineDescription: VirtualMachineDescription{
+			Machine:  vm,
+			Alive:    true,
+			Images:   []*v1.Image{image},
+			Metadata: map[string]string{"name": "web"},
+			VNCServers: []*v1.VNCServer{
+				{Sockets: []*v1.VNCServerSocket{{Port: 5901, Family: v1.NetworkAddressFamily_IPV6, IsWebSocket: true}}, Display: &display},
+				{},
+			},
+		},
+		KindImageDescription: ImageDescription{Image: image, Metadata: map[string]string{}, AttachedTo: []*v1.UUID{id}},
+		KindAction: Action{
+			Op:       OpUpdate,
+			Resource: KindImage,
+			Name:     "web-root",
+			Id:       id,
+			Image:    "web-root",
+			Before:   map[string]string{"size": "1"},
+			After:    map[string]string{"size": "2"},
+		},
+		KindError: ErrorReport{Type: "NotFound", Code: "NotFound", Message: "no such image", ExitCode: ExitNotFound},
+	}
+
+	var names []string
+	for kind := range kinds {
+		names = append(names, string(kind))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		kind := Kind(name)
+		t.Run(name, func(t *testing.T) {
+			item, ok := items[kind]
+			if !ok {
+				t.Fatalf("no test item of kind %s", kind)
+			}
+
+			schema, err := kindSchema(kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defs, _ := schema["$defs"].(map[string]interface{})
+
+			for _, item := range []interface{}{item, kinds[kind]} {
+				data, err := envelope(kind, item)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := validate(schema, defs, decodeJSON(t, string(data)), "$"); err != nil {
+					t.Errorf("%s doesn't match the schema: %v", data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMismatches(t *testing.T) {
+	schema, err := kindSchema(KindVirtualMachineStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"wrong kind", `{"apiVersion":"kitsh/v1","kind":"Image","id":{"value":"a"},"alive":true}`},
+		{"missing property", `{"apiVersion":"kitsh/v1","kind":"VirtualMachineStatus","alive":true}`},
+		{"unexpected property", `{"apiVersion":"kitsh/v1","kind":"VirtualMachineStatus","id":{"value":"a"},"alive":true,"name":"web"}`},
+		{"wrong type", `{"apiVersion":"kitsh/v1","kind":"VirtualMachineStatus","id":{"value":"a"},"alive":"yes"}`},
+		{"wrong nested type", `{"apiVersion":"kitsh/v1","kind":"VirtualMachineStatus","id":{"value":1},"alive":true}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validate(schema, schema["$defs"].(map[string]interface{}), decodeJSON(t, test.json), "$"); err == nil {
+				t.Errorf("%s matches the schema", test.json)
+			}
+		})
+	}
+}
+
+func TestKindSchemaUnknown(t *testing.T) {
+	if _, err := kindSchema("Unknown"); !errors.Is(err, UnknownKind) {
+		t.Errorf("kindSchema() = %v, want %v", err, UnknownKind)
+	}
+}
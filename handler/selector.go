@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"github.com/urfave/cli/v2"
+	"regexp"
+	"strings"
+)
+
+// InvalidSelector is an error about a malformed label selector.
+var InvalidSelector = errors.New("invalid selector")
+
+// MissingIdOrSelector is an error about a command being invoked with neither or both of an ID and a selector.
+var MissingIdOrSelector = errors.New("exactly one of --id and --selector must be supplied")
+
+// Operator is an operator of a selector requirement.
+type Operator string
+
+const (
+	// OperatorEquals matches items with the key set to the value.
+	OperatorEquals Operator = "="
+	// OperatorNotEquals matches items without the key or with the key set to another value.
+	OperatorNotEquals Operator = "!="
+	// OperatorIn matches items with the key set to any of the values.
+	OperatorIn Operator = "in"
+	// OperatorNotIn matches items without the key or with the key set to none of the values.
+	OperatorNotIn Operator = "notin"
+	// OperatorExists matches items with the key.
+	OperatorExists Operator = "exists"
+	// OperatorDoesNotExist matches items without the key.
+	OperatorDoesNotExist Operator = "!"
+)
+
+// Requirement is a single expression of a selector, like "env=prod" or "team in (infra,ops)".
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Selector is a Kubernetes-style label selector evaluated against metadata, all requirements must match.
+type Selector []Requirement
+
+// setRequirementRegex matches "key in (a,b)" and "key notin (a,b)" requirements.
+var setRequirementRegex = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// ParseSelector parses a comma-separated list of requirements: "key=value", "key==value", "key!=value",
+// "key in (a,b)", "key notin (a,b)", "key" (exists) and "!key" (does not exist).
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, term := range splitTerms(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, fmt.Errorf("%w: empty requirement in %q", InvalidSelector, s)
+		}
+
+		req, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, req)
+	}
+
+	return selector, nil
+}
+
+// splitTerms splits the supplied selector on commas outside of parentheses.
+func splitTerms(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(terms, s[start:])
+}
+
+// parseRequirement parses a single requirement of a selector.
+func parseRequirement(term string) (Requirement, error) {
+	var req Requirement
+	if match := setRequirementRegex.FindStringSubmatch(term); match != nil {
+		req = Requirement{Key: match[1], Operator: Operator(match[2])}
+		for _, value := range strings.Split(match[3], ",") {
+			req.Values = append(req.Values, strings.TrimSpace(value))
+		}
+	} else if key, value, ok := strings.Cut(term, "!="); ok {
+		req = Requirement{Key: key, Operator: OperatorNotEquals, Values: []string{value}}
+	} else if key, value, ok := strings.Cut(term, "=="); ok {
+		req = Requirement{Key: key, Operator: OperatorEquals, Values: []string{value}}
+	} else if key, value, ok := strings.Cut(term, "="); ok {
+		req = Requirement{Key: key, Operator: OperatorEquals, Values: []string{value}}
+	} else if strings.HasPrefix(term, "!") {
+		req = Requirement{Key: strings.TrimPrefix(term, "!"), Operator: OperatorDoesNotExist}
+	} else {
+		req = Requirement{Key: term, Operator: OperatorExists}
+	}
+
+	req.Key = strings.TrimSpace(req.Key)
+	if req.Key == "" || strings.ContainsAny(req.Key, " \t()!=") {
+		return Requirement{}, fmt.Errorf("%w: invalid key in %q", InvalidSelector, term)
+	}
+	for i, value := range req.Values {
+		req.Values[i] = strings.TrimSpace(value)
+		if strings.ContainsAny(req.Values[i], "()") {
+			return Requirement{}, fmt.Errorf("%w: invalid value in %q", InvalidSelector, term)
+		}
+	}
+
+	return req, nil
+}
+
+// Matches checks whether the supplied metadata satisfies the requirement.
+func (r Requirement) Matches(data map[string]string) bool {
+	value, ok := data[r.Key]
+
+	switch r.Operator {
+	case OperatorEquals, OperatorIn:
+		return ok && containsString(r.Values, value)
+	case OperatorNotEquals, OperatorNotIn:
+		return !ok || !containsString(r.Values, value)
+	case OperatorExists:
+		return ok
+	case OperatorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// Matches checks whether the supplied metadata satisfies all requirements of the selector.
+func (s Selector) Matches(data map[string]string) bool {
+	for _, req := range s {
+		if !req.Matches(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString checks whether the supplied values contain the supplied value.
+func containsString(values []string, value string) bool {
+	for _, other := range values {
+		if other == value {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorFlag parses the "selector" flag, returning nil if it wasn't supplied.
+func selectorFlag(cCtx *cli.Context) (Selector, error) {
+	if !cCtx.IsSet("selector") {
+		return nil, nil
+	}
+	return ParseSelector(cCtx.String("selector"))
+}
+
+// Select lists the IDs of all entities whose metadata matches the supplied selector.
+func (r *Resolver) Select(ctx context.Context, selector Selector) ([]*v1.UUID, error) {
+	ids, err := r.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.filter(ctx, ids, selector.Matches)
+}
+
+// Targets resolves the entities a command applies to, either the one referenced by the "id" flag
+// or all entities matching the "selector" flag.
+func (r *Resolver) Targets(cCtx *cli.Context) ([]*v1.UUID, error) {
+	selector, err := selectorFlag(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := cCtx.String("id")
+	if (ref == "") == (selector == nil) {
+		return nil, MissingIdOrSelector
+	}
+
+	if selector != nil {
+		return r.Select(cCtx.Context, selector)
+	}
+
+	id, err := r.Resolve(cCtx.Context, ref)
+	if err != nil {
+		return nil, err
+	}
+	return []*v1.UUID{id}, nil
+}
+
+// forEachTarget invokes the supplied callback for every supplied target, stopping at the first error.
+// Errors are annotated with the failed target if there are multiple targets.
+func forEachTarget(ids []*v1.UUID, forEach func(id *v1.UUID) error) error {
+	for _, id := range ids {
+		if err := forEach(id); err != nil {
+			if len(ids) > 1 {
+				return fmt.Errorf("%s: %w", id.GetValue(), err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		wantErr  bool
+	}{
+		{"env=prod", Selector{{Key: "env", Operator: OperatorEquals, Values: []string{"prod"}}}, false},
+		{"env==prod", Selector{{Key: "env", Operator: OperatorEquals, Values: []string{"prod"}}}, false},
+		{"env!=prod", Selector{{Key: "env", Operator: OperatorNotEquals, Values: []string{"prod"}}}, false},
+		{"env=", Selector{{Key: "env", Operator: OperatorEquals, Values: []string{""}}}, false},
+		{"team in (infra, ops)", Selector{{Key: "team", Operator: OperatorIn, Values: []string{"infra", "ops"}}}, false},
+		{"team notin (infra)", Selector{{Key: "team", Operator: OperatorNotIn, Values: []string{"infra"}}}, false},
+		{"owner", Selector{{Key: "owner", Operator: OperatorExists}}, false},
+		{"!owner", Selector{{Key: "owner", Operator: OperatorDoesNotExist}}, false},
+		{
+			" env = prod , team in (a,b), !legacy",
+			Selector{
+				{Key: "env", Operator: OperatorEquals, Values: []string{"prod"}},
+				{Key: "team", Operator: OperatorIn, Values: []string{"a", "b"}},
+				{Key: "legacy", Operator: OperatorDoesNotExist},
+			},
+			false,
+		},
+		{"", nil, true},
+		{"env=prod,", nil, true},
+		{"=prod", nil, true},
+		{"!", nil, true},
+		{"my key=prod", nil, true},
+		{"team in (a,(b))", nil, true},
+		{"env=(prod)", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			got, err := ParseSelector(test.selector)
+			if test.wantErr {
+				if !errors.Is(err, InvalidSelector) {
+					t.Errorf("ParseSelector() error = %v, want %v", err, InvalidSelector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseSelector() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	data := map[string]string{"env": "prod", "team": "infra", "empty": ""}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"env=prod", true},
+		{"env=stage", false},
+		{"env!=stage", true},
+		{"missing!=stage", true},
+		{"empty=", true},
+		{"team in (infra,ops)", true},
+		{"team in (ops)", false},
+		{"missing in (ops)", false},
+		{"team notin (ops)", true},
+		{"missing notin (ops)", true},
+		{"env", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!env", false},
+		{"env=prod,team=infra", true},
+		{"env=prod,team=ops", false},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector() failed: %v", err)
+			}
+			if got := selector.Matches(data); got != test.want {
+				t.Errorf("Matches() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolverSelect(t *testing.T) {
+	const (
+		web  = "3f2a0c1e-8b9d-4e5f-a6b7-c8d9e0f1a2b3"
+		db   = "3f2b1d2f-9cae-4f60-b7c8-d9eaf1a2b3c4"
+		gone = "abcd2e3f-adbf-4071-88d9-eafb02b3c4d5"
+	)
+	resolver := newMemoryResolver(&memoryRegistry{data: map[string]map[string]string{
+		web: {"name": "web", "env": "prod"},
+		db:  {"name": "db", "env": "stage"},
+	}}, "name")
+	list := resolver.list
+	resolver.list = func(ctx context.Context) ([]*v1.UUID, error) {
+		ids, err := list(ctx)
+		return append(ids, &v1.UUID{Value: gone}), err // deleted after being listed
+	}
+
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"env=prod", []string{web}},
+		{"env", []string{web, db}},
+		{"env=test", []string{}},
+		{"!env", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector() failed: %v", err)
+			}
+
+			ids, err := resolver.Select(context.Background(), selector)
+			if err != nil {
+				t.Fatalf("Select() failed: %v", err)
+			}
+			got := make([]string, len(ids))
+			for i, id := range ids {
+				got[i] = id.GetValue()
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Select() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
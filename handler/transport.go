@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnsupportedTargetScheme is an error about a target with an unknown URL scheme.
+var UnsupportedTargetScheme = errors.New("unsupported target scheme, expected host:port, unix:///path or ssh://[user@]bastion[:port]/host:port")
+
+// InvalidTarget is an error about a malformed target.
+var InvalidTarget = errors.New("invalid target")
+
+// NoSSHAuthMethods is an error about neither an SSH agent nor a default private key being available.
+var NoSSHAuthMethods = errors.New("no SSH authentication methods available, start an SSH agent or create a key in ~/.ssh")
+
+// Target is a parsed kitsune target.
+type Target struct {
+	// Scheme is the transport of the target, "tcp", "unix" or "ssh".
+	Scheme string
+	// Address is the kitsune address, a socket path for "unix" targets, otherwise a host:port pair
+	// (as seen from the bastion for "ssh" targets).
+	Address string
+	// SSHUser is the user to log in to the bastion with.
+	SSHUser string
+	// SSHHost is the host:port pair of the bastion.
+	SSHHost string
+}
+
+// sshClients is a cache of SSH connections to bastions, keyed by "user@host:port".
+var sshClients = make(map[string]*ssh.Client)
+
+// sshClientsMu guards sshClients, gRPC dials connections concurrently.
+var sshClientsMu sync.Mutex
+
+// sshDialTimeout bounds connecting and logging in to a bastion.
+const sshDialTimeout = 15 * time.Second
+
+// parseTarget parses a plain host:port target, a "unix:///path/to.sock" target
+// or a "ssh://[user@]bastion[:port]/host:port" target.
+func parseTarget(target string) (*Target, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		if strings.HasPrefix(target, "unix:") {
+			return &Target{Scheme: "unix", Address: strings.TrimPrefix(target, "unix:")}, nil
+		}
+		return &Target{Scheme: "tcp", Address: target}, nil
+	}
+
+	switch scheme {
+	case "unix":
+		if rest == "" {
+			return nil, fmt.Errorf("%w: %s", InvalidTarget, target)
+		}
+		return &Target{Scheme: "unix", Address: rest}, nil
+	case "ssh":
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+
+		address := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || address == "" {
+			return nil, fmt.Errorf("%w: %s", InvalidTarget, target)
+		}
+
+		sshHost := u.Host
+		if u.Port() == "" {
+			sshHost = net.JoinHostPort(u.Hostname(), "22")
+		}
+
+		sshUser := u.User.Username()
+		if sshUser == "" {
+			if current, err := user.Current(); err == nil {
+				sshUser = current.Username
+			}
+		}
+
+		return &Target{Scheme: "ssh", Address: address, SSHUser: sshUser, SSHHost: sshHost}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", UnsupportedTargetScheme, scheme)
+}
+
+// dialOptions produces the gRPC target and dial options for connecting over the transport of the target.
+func (t *Target) dialOptions() (string, []grpc.DialOption) {
+	switch t.Scheme {
+	case "unix":
+		if filepath.IsAbs(t.Address) {
+			return "unix://" + t.Address, nil
+		}
+		return "unix:" + t.Address, nil
+	case "ssh":
+		return "passthrough:///" + t.Address, []grpc.DialOption{
+			grpc.WithContextDialer(t.dial),
+		}
+	}
+
+	return t.Address, nil
+}
+
+// dial opens a connection to the supplied address through the bastion of the target, giving up once ctx is done.
+// The cached bastion connection is dropped on failures, so that the next attempt reconnects.
+func (t *Target) dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := t.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr) // not cancellable
+		done <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.evictSSHClient(client)
+		}
+		return res.conn, res.err
+	case <-ctx.Done():
+		t.evictSSHClient(client) // most likely unresponsive
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// sshClient connects to the bastion of the target (or gets a cached connection), giving up after sshDialTimeout
+// or once ctx is done. The connection is dropped from the cache once it is closed.
+func (t *Target) sshClient(ctx context.Context) (*ssh.Client, error) {
+	sshClientsMu.Lock()
+	defer sshClientsMu.Unlock()
+
+	if client, ok := sshClients[t.sshKey()]; ok {
+		return client, nil
+	}
+
+	config, err := sshClientConfig(t.SSHUser)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.SSHHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bastion %s: %w", t.SSHHost, err)
+	}
+
+	// the handshake can't be cancelled, only bounded by a deadline
+	deadline := time.Now().Add(sshDialTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.SSHHost, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to bastion %s: %w", t.SSHHost, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	sshClients[t.sshKey()] = client
+	go func() {
+		_ = client.Wait()
+		t.evictSSHClient(client)
+	}()
+
+	return client, nil
+}
+
+// evictSSHClient closes the supplied bastion connection and drops it from the cache, if it is still cached.
+func (t *Target) evictSSHClient(client *ssh.Client) {
+	sshClientsMu.Lock()
+	defer sshClientsMu.Unlock()
+
+	if sshClients[t.sshKey()] == client {
+		delete(sshClients, t.sshKey())
+	}
+	_ = client.Close()
+}
+
+// sshKey gets the key of the bastion connection of the target in sshClients.
+func (t *Target) sshKey() string {
+	return t.SSHUser + "@" + t.SSHHost
+}
+
+// sshClientConfig creates an SSH client configuration authenticating with the SSH agent and the default
+// unencrypted private keys, verifying host keys with ~/.ssh/known_hosts.
+func sshClientConfig(username string) (*ssh.ClientConfig, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := knownhosts.New(filepath.Join(homeDir, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := os.ReadFile(filepath.Join(homeDir, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, NoSSHAuthMethods
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// vncAddress produces the host:port pair under which a browser can reach the supplied port on the kitsune host.
+// For SSH targets, a local listener forwarding connections through the bastion is started until ctx is done.
+func (t *Target) vncAddress(ctx context.Context, port uint32) (string, error) {
+	switch t.Scheme {
+	case "unix":
+		return net.JoinHostPort("localhost", fmt.Sprint(port)), nil
+	case "ssh":
+		host, _, err := net.SplitHostPort(t.Address)
+		if err != nil {
+			return "", err
+		}
+		return t.forward(ctx, net.JoinHostPort(host, fmt.Sprint(port)))
+	}
+
+	host, _, err := net.SplitHostPort(t.Address)
+	if err != nil {
+		host = t.Address // no port
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+// forward starts a local listener forwarding connections to the supplied address through the bastion,
+// returning the address of the listener.
+func (t *Target) forward(ctx context.Context, remote string) (string, error) {
+	// connect upfront, so that an unreachable bastion is reported right away
+	if _, err := t.sshClient(ctx); err != nil {
+		return "", err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer local.Close()
+
+				remoteConn, err := t.dial(ctx, remote)
+				if err != nil {
+					PrintError("failed to forward connection to %s: %s\n", remote, err)
+					return
+				}
+				defer remoteConn.Close()
+
+				go io.Copy(remoteConn, local)
+				io.Copy(local, remoteConn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
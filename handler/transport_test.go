@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	currentUser := ""
+	if current, err := user.Current(); err == nil {
+		currentUser = current.Username
+	}
+
+	tests := []struct {
+		target     string
+		want       Target
+		grpcTarget string
+		wantErr    error
+	}{
+		{"localhost:8080", Target{Scheme: "tcp", Address: "localhost:8080"}, "localhost:8080", nil},
+		{"[::1]:8080", Target{Scheme: "tcp", Address: "[::1]:8080"}, "[::1]:8080", nil},
+		{"unix:///run/kitsune.sock", Target{Scheme: "unix", Address: "/run/kitsune.sock"}, "unix:///run/kitsune.sock", nil},
+		{"unix:kitsune.sock", Target{Scheme: "unix", Address: "kitsune.sock"}, "unix:kitsune.sock", nil},
+		{"unix://kitsune.sock", Target{Scheme: "unix", Address: "kitsune.sock"}, "unix:kitsune.sock", nil},
+		{
+			"ssh://ops@bastion:2222/10.0.0.5:8080",
+			Target{Scheme: "ssh", Address: "10.0.0.5:8080", SSHUser: "ops", SSHHost: "bastion:2222"},
+			"passthrough:///10.0.0.5:8080",
+			nil,
+		},
+		{
+			"ssh://bastion/kitsune:8080",
+			Target{Scheme: "ssh", Address: "kitsune:8080", SSHUser: currentUser, SSHHost: "bastion:22"},
+			"passthrough:///kitsune:8080",
+			nil,
+		},
+		{"unix://", Target{}, "", InvalidTarget},
+		{"ssh://bastion", Target{}, "", InvalidTarget},
+		{"ssh:///kitsune:8080", Target{}, "", InvalidTarget},
+		{"http://kitsune:8080", Target{}, "", UnsupportedTargetScheme},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			target, err := parseTarget(test.target)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("parseTarget() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTarget() failed: %v", err)
+			}
+			if *target != test.want {
+				t.Errorf("parseTarget() = %+v, want %+v", *target, test.want)
+			}
+			if grpcTarget, _ := target.dialOptions(); grpcTarget != test.grpcTarget {
+				t.Errorf("dialOptions() target = %s, want %s", grpcTarget, test.grpcTarget)
+			}
+		})
+	}
+}
+
+// testBastion is an SSH server accepting the key of the test user, rejecting every forwarded connection.
+type testBastion struct {
+	addr  string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newTestBastion starts a testBastion on a random local port, pointing HOME to a directory
+// with the key of the test user and the host key of the bastion.
+func newTestBastion(t *testing.T) *testBastion {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	userKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSigner, err := ssh.NewSignerFromKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), userSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+
+	b := &testBastion{addr: lis.Addr().String()}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					_ = ch.Reject(ssh.ConnectionFailed, "connection refused")
+				}
+			}()
+		}
+	}()
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(sshDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	knownHost := knownhosts.Line([]string{knownhosts.Normalize(b.addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(knownHost+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sshDir, "id_ecdsa"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// closeAll closes all connections accepted by the bastion.
+func (b *testBastion) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.conns = nil
+}
+
+// cachedSSHClient gets the cached bastion connection of the supplied target.
+func cachedSSHClient(target *Target) *ssh.Client {
+	sshClientsMu.Lock()
+	defer sshClientsMu.Unlock()
+
+	return sshClients[target.sshKey()]
+}
+
+func TestSSHClient(t *testing.T) {
+	bastion := newTestBastion(t)
+	target := &Target{Scheme: "ssh", Address: "kitsune:8080", SSHUser: "ops", SSHHost: bastion.addr}
+
+	client, err := target.sshClient(context.Background())
+	if err != nil {
+		t.Fatalf("sshClient() failed: %v", err)
+	}
+	if cached, err := target.sshClient(context.Background()); err != nil || cached != client {
+		t.Fatalf("sshClient() = %p, %v, want the cached connection %p", cached, err, client)
+	}
+
+	// a failed dial drops the connection
+	if _, err := target.dial(context.Background(), target.Address); err == nil {
+		t.Fatalf("dial() succeeded, want a rejected connection")
+	}
+	if cached := cachedSSHClient(target); cached != nil {
+		t.Errorf("connection still cached after a failed dial")
+	}
+
+	// so does a closed one
+	client, err = target.sshClient(context.Background())
+	if err != nil {
+		t.Fatalf("sshClient() failed: %v", err)
+	}
+	bastion.closeAll()
+	for deadline := time.Now().Add(5 * time.Second); cachedSSHClient(target) == client; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still cached after being closed")
+		}
+	}
+}
+
+func TestSSHClientHandshakeTimeout(t *testing.T) {
+	newTestBastion(t) // for the client configuration
+
+	// accepts connections, but never speaks SSH
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	target := &Target{Scheme: "ssh", Address: "kitsune:8080", SSHUser: "ops", SSHHost: lis.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := target.sshClient(ctx); err == nil {
+		t.Fatalf("sshClient() succeeded, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sshClient() took %s, want it to give up with the context", elapsed)
+	}
+	if cached := cachedSSHClient(target); cached != nil {
+		t.Errorf("failed connection cached")
+	}
+}
@@ -2,22 +2,23 @@ package handler
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
 	"github.com/lusory/kitsh"
-	"github.com/lusory/libkitsune"
 	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
-	"github.com/rodaine/table"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"io"
 	"io/fs"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -25,6 +26,9 @@ import (
 // UnknownArchitecture is an error about an unknown architecture.
 var UnknownArchitecture = errors.New("unknown architecture")
 
+// InvalidDisk is an error about a malformed disk of the "vm create" command.
+var InvalidDisk = errors.New("invalid disk")
+
 // InvalidRAMSize is an error about an invalid RAM memory size (size must be positive).
 var InvalidRAMSize = errors.New("invalid ram size")
 
@@ -52,50 +56,79 @@ func forEachVms(vms v1.VirtualMachineRegistryService_GetVirtualMachinesClient, f
 	return nil
 }
 
+// findVirtualMachine finds the virtual machine with the supplied ID, failing with a NotFound KitshError if it doesn't exist.
+func findVirtualMachine(ctx context.Context, registry v1.VirtualMachineRegistryServiceClient, id *v1.UUID) (*v1.VirtualMachine, error) {
+	res, err := registry.FindVirtualMachine(ctx, &v1.FindVirtualMachineRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	if res.GetMachine() == nil {
+		return nil, &KitshError{Code: codes.NotFound, Msg: fmt.Sprintf("virtual machine %s does not exist", id.GetValue())}
+	}
+
+	return res.GetMachine(), nil
+}
+
 // ListVirtualMachines is a handler for the "vm list" command.
 func ListVirtualMachines(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	vms, err := client.VmRegistry.GetVirtualMachines(cCtx.Context, &emptypb.Empty{})
+	selector, err := selectorFlag(cCtx)
 	if err != nil {
 		return err
 	}
 
-	if cCtx.Bool("no-pretty") {
-		err = forEachVms(vms, func(vm *v1.VirtualMachine) error {
-			data, err := json.Marshal(vm)
-			if err != nil {
-				return err
-			}
+	stream, err := client.VmRegistry.GetVirtualMachines(cCtx.Context, &emptypb.Empty{})
+	if err != nil {
+		return err
+	}
 
-			fmt.Println(string(data))
-			return nil
-		})
-		if err != nil {
+	// the stream is read up front, it isn't kept open while fetching metadata
+	var (
+		vms []*v1.VirtualMachine
+		ids []*v1.UUID
+	)
+	err = forEachVms(stream, func(vm *v1.VirtualMachine) error {
+		vms, ids = append(vms, vm), append(ids, vm.GetId())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := NewOutput(KindVirtualMachine, "ID", "Architecture", "Memory size").WithWide("Metadata")
+	wide := isWideOutput(cCtx)
+
+	var data []map[string]string
+	if wide || selector != nil {
+		if data, err = fetchAllMetadata(cCtx.Context, client.VmRegistry, ids); err != nil {
 			return err
 		}
-	} else {
-		tbl := table.New("ID", "Architecture", "Memory size")
+	}
 
-		err = forEachVms(vms, func(vm *v1.VirtualMachine) error {
-			tbl.AddRow(vm.GetId().GetValue(), vm.GetArch(), vm.GetMemorySize())
-			return nil
-		})
-		if err != nil {
-			return err
+	for i, vm := range vms {
+		row := []interface{}{vm.GetId().GetValue(), vm.GetArch(), vm.GetMemorySize()}
+		if data != nil {
+			if data[i] == nil || !selector.Matches(data[i]) { // deleted in the meantime or not selected
+				continue
+			}
+			if wide {
+				row = append(row, formatMetadata(data[i]))
+			}
 		}
-		tbl.Print()
+
+		out.Add(vm, row...)
 	}
 
-	return nil
+	return out.Render(cCtx)
 }
 
 // CreateVirtualMachine is a handler for the "vm create" command.
 func CreateVirtualMachine(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
@@ -110,90 +143,176 @@ func CreateVirtualMachine(cCtx *cli.Context) error {
 		return UnknownArchitecture
 	}
 
-	data := make(map[string]string)
-	if err := json.Unmarshal([]byte(cCtx.String("data")), &data); err != nil {
+	data, err := metadataFlags(cCtx)
+	if err != nil {
 		return err
 	}
 
-	oneof, err := client.VmRegistry.CreateVirtualMachine(
-		cCtx.Context,
-		&v1.CreateVirtualMachineRequest{
-			Arch:       v1.Architecture(arch),
-			MemorySize: mem,
-			Data: &v1.MetadataMap{
-				Data: data,
-			},
-		},
-	)
+	var disks []*diskSpec
+	for _, spec := range cCtx.StringSlice("disk") {
+		disk, err := parseDisk(spec)
+		if err != nil {
+			return err
+		}
+		disks = append(disks, disk)
+	}
 
+	// resolve before creating anything, so that unknown images don't require a rollback
+	resolver := newImageResolver(cCtx, client)
+	var attach []*v1.UUID
+	for _, ref := range cCtx.StringSlice("attach") {
+		id, err := resolver.Resolve(cCtx.Context, ref)
+		if err != nil {
+			return err
+		}
+		attach = append(attach, id)
+	}
+
+	vm, err := createVirtualMachine(cCtx.Context, client, v1.Architecture(arch), mem, data)
 	if err != nil {
 		return err
 	}
-	if oneof.GetError() != nil {
-		return formatError(oneof.GetError())
+
+	rb := &rollback{}
+	rb.add("delete virtual machine "+vm.GetId().GetValue(), func(ctx context.Context) error {
+		return deleteVirtualMachine(ctx, client, vm.GetId())
+	})
+	for _, disk := range disks {
+		if _, err := attachNewImage(cCtx.Context, client, rb, vm.GetId(), disk.format, disk.size, disk.data); err != nil {
+			return rb.run(fmt.Errorf("failed to create disk %s: %w", disk.spec, err))
+		}
+	}
+	for _, id := range attach {
+		if err := attachExistingImage(cCtx.Context, client, rb, vm.GetId(), id); err != nil {
+			return rb.run(err)
+		}
 	}
 
-	vm := oneof.GetMachine()
+	out := NewOutput(KindVirtualMachine, "ID", "Architecture", "Memory size")
+	out.Add(
+		vm,
+		vm.GetId().GetValue(),
+		vm.GetArch(),
+		vm.GetMemorySize(),
+	)
 
-	if cCtx.Bool("no-pretty") {
-		data, err := json.Marshal(vm)
-		if err != nil {
-			return err
+	return out.Render(cCtx)
+}
+
+// diskSpec is an image created and attached along with a virtual machine.
+type diskSpec struct {
+	spec   string
+	format v1.Image_Format
+	size   uint64
+	data   map[string]string
+}
+
+// parseDisk parses a disk in the "format:size[:key=value...]" format, e.g. "qcow2:10G:name=root".
+func parseDisk(spec string) (*diskSpec, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%w: %q is not in the format:size[:key=value...] format", InvalidDisk, spec)
+	}
+
+	format, ok := v1.Image_Format_value[strings.ToUpper(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: %s %q", InvalidDisk, spec, UnknownFormat, parts[0])
+	}
+
+	size, err := parseSize(parts[1])
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("%w: %s: %s %q", InvalidDisk, spec, InvalidImageSize, parts[1])
+	}
+
+	disk := &diskSpec{spec: spec, format: v1.Image_Format(format), size: size, data: make(map[string]string)}
+	for _, pair := range parts[2:] {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %s: %q is not in the key=value format", InvalidDisk, spec, pair)
 		}
+		disk.data[key] = value
+	}
 
-		fmt.Println(string(data))
-	} else {
-		tbl := table.New("ID", "Architecture", "Memory size")
-		tbl.AddRow(
-			vm.GetId().GetValue(),
-			vm.GetArch(),
-			vm.GetMemorySize(),
-		)
-		tbl.Print()
+	return disk, nil
+}
+
+// sizeUnits are the binary multipliers of size suffixes.
+var sizeUnits = map[string]uint64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix (powers of 1024), e.g. "512M".
+func parseSize(s string) (uint64, error) {
+	num := strings.TrimRight(strings.ToUpper(s), "KMGT")
+	unit, ok := sizeUnits[strings.ToUpper(s)[len(num):]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size suffix in %q", s)
 	}
 
-	return nil
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/unit {
+		return 0, fmt.Errorf("size %q overflows", s)
+	}
+	return n * unit, nil
 }
 
 // DeleteVirtualMachine is a handler for the "vm delete" command.
 func DeleteVirtualMachine(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	ids, err := newVmResolver(cCtx, client).Targets(cCtx)
 	if err != nil {
 		return err
 	}
 
-	res, err := client.VmRegistry.DeleteVirtualMachine(
-		cCtx.Context,
-		&v1.DeleteVirtualMachineRequest{
-			Id: &v1.UUID{
-				Value: id.String(),
-			},
-		},
-	)
+	if cCtx.Bool("cascade") {
+		return deleteVirtualMachinesCascade(cCtx, client, ids)
+	}
+
+	if err := checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, "delete", ids...); err != nil {
+		return err
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: "delete", kind: KindVirtualMachine, ids: ids}); err != nil {
+		return err
+	}
+
+	return forEachTarget(ids, func(id *v1.UUID) error {
+		return deleteVirtualMachine(cCtx.Context, client, id)
+	})
+}
 
+// ProtectVirtualMachine is a handler for the "vm protect" command.
+func ProtectVirtualMachine(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
-	if res.GetError() != nil {
-		return formatError(res.GetError())
+
+	return ProtectFunc(client.VmRegistry, newVmResolver(cCtx, client), true)(cCtx)
+}
+
+// UnprotectVirtualMachine is a handler for the "vm unprotect" command.
+func UnprotectVirtualMachine(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return ProtectFunc(client.VmRegistry, newVmResolver(cCtx, client), false)(cCtx)
 }
 
 // GetStatus is a handler for the "vm status" command.
 func GetStatus(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	id, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
 	if err != nil {
 		return err
 	}
@@ -201,9 +320,7 @@ func GetStatus(cCtx *cli.Context) error {
 	res, err := client.VmRegistry.IsAlive(
 		cCtx.Context,
 		&v1.IsAliveRequest{
-			Id: &v1.UUID{
-				Value: id.String(),
-			},
+			Id: id,
 		},
 	)
 
@@ -214,9 +331,7 @@ func GetStatus(cCtx *cli.Context) error {
 		return formatError(res.GetError())
 	}
 
-	if cCtx.Bool("no-pretty") {
-		fmt.Println(res.GetAlive())
-	} else {
+	if format, _, _ := outputFormat(cCtx); format == OutputTable {
 		fmt.Print("Status: ")
 		if res.GetAlive() {
 			PrintSuccess("Running\n")
@@ -224,18 +339,27 @@ func GetStatus(cCtx *cli.Context) error {
 			// not using PrintError, don't want to print to stderr here
 			_, _ = ErrorColor.Println("Stopped")
 		}
+		return nil
 	}
-	return nil
+
+	out := NewOutput(KindVirtualMachineStatus, "ID", "Status")
+	out.Add(
+		VirtualMachineStatus{Id: id, Alive: res.GetAlive()},
+		id.GetValue(),
+		formatStatus(res.GetAlive()),
+	)
+
+	return out.Render(cCtx)
 }
 
 // Images is a handler for the "vm images" command.
 func Images(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	id, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
 	if err != nil {
 		return err
 	}
@@ -243,9 +367,7 @@ func Images(cCtx *cli.Context) error {
 	images, err := client.VmRegistry.GetAttachedImages(
 		cCtx.Context,
 		&v1.GetAttachedImagesRequest{
-			Id: &v1.UUID{
-				Value: id.String(),
-			},
+			Id: id,
 		},
 	)
 	if err != nil {
@@ -255,36 +377,28 @@ func Images(cCtx *cli.Context) error {
 		return formatError(images.GetError())
 	}
 
-	if cCtx.Bool("no-pretty") {
-		for _, image := range images.GetImages() {
-			fmt.Println(image.GetValue())
-		}
-	} else {
-		tbl := table.New("Image ID")
-
-		for _, image := range images.GetImages() {
-			tbl.AddRow(image.GetValue())
-		}
-
-		tbl.Print()
+	out := NewOutput(KindAttachedImages, "Image ID")
+	out.AddItem(AttachedImages{Id: id, Images: images.GetImages()})
+	for _, image := range images.GetImages() {
+		out.AddRow(image.GetValue())
 	}
 
-	return nil
+	return out.Render(cCtx)
 }
 
 // AttachImage is a handler for the "vm attach" command.
 func AttachImage(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	id, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
 	if err != nil {
 		return err
 	}
 
-	image, err := uuid.Parse(cCtx.String("image"))
+	image, err := newImageResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("image"))
 	if err != nil {
 		return err
 	}
@@ -292,12 +406,8 @@ func AttachImage(cCtx *cli.Context) error {
 	res, err := client.VmRegistry.AttachImage(
 		cCtx.Context,
 		&v1.AttachImageRequest{
-			Machine: &v1.UUID{
-				Value: id.String(),
-			},
-			Image: &v1.UUID{
-				Value: image.String(),
-			},
+			Machine: id,
+			Image:   image,
 		},
 	)
 	if err != nil {
@@ -312,17 +422,29 @@ func AttachImage(cCtx *cli.Context) error {
 
 // DetachImage is a handler for the "vm detach" command.
 func DetachImage(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	id, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
 	if err != nil {
 		return err
 	}
 
-	image, err := uuid.Parse(cCtx.String("image"))
+	image, err := newImageResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("image"))
+	if err != nil {
+		return err
+	}
+
+	err = runConcurrently(
+		func() error {
+			return checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, "detach images from", id)
+		},
+		func() error {
+			return checkProtected(cCtx.Context, client.ImageRegistry, KindImage, "detach", image)
+		},
+	)
 	if err != nil {
 		return err
 	}
@@ -330,12 +452,8 @@ func DetachImage(cCtx *cli.Context) error {
 	res, err := client.VmRegistry.DetachImage(
 		cCtx.Context,
 		&v1.DetachImageRequest{
-			Machine: &v1.UUID{
-				Value: id.String(),
-			},
-			Image: &v1.UUID{
-				Value: image.String(),
-			},
+			Machine: id,
+			Image:   image,
 		},
 	)
 	if err != nil {
@@ -350,12 +468,12 @@ func DetachImage(cCtx *cli.Context) error {
 
 // VNC is a handler for the "vm vnc" command.
 func VNC(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	id, err := newVmResolver(cCtx, client).Resolve(cCtx.Context, cCtx.String("id"))
 	if err != nil {
 		return err
 	}
@@ -363,9 +481,7 @@ func VNC(cCtx *cli.Context) error {
 	res, err := client.VmRegistry.GetVNCServers(
 		cCtx.Context,
 		&v1.GetVNCServersRequest{
-			Id: &v1.UUID{
-				Value: id.String(),
-			},
+			Id: id,
 		},
 	)
 	if err != nil {
@@ -385,14 +501,32 @@ func VNC(cCtx *cli.Context) error {
 		httpHost = "localhost" + httpHost
 	}
 
-	vncHost := cCtx.String("target")
-	if strings.Contains(vncHost, ":") { // remove port
-		vncHost = strings.SplitN(vncHost, ":", 2)[0]
+	settings, err := resolveSettings(cCtx)
+	if err != nil {
+		return err
+	}
+
+	target, err := parseTarget(settings.Target)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(cCtx.Context)
+	defer cancel() // stops SSH forwarding
+
+	vncAddr, err := target.vncAddress(ctx, sock.GetPort())
+	if err != nil {
+		return err
+	}
+
+	vncHost, vncPort, err := net.SplitHostPort(vncAddr)
+	if err != nil {
+		return err
 	}
 
 	//goland:noinspection HttpUrlsUsage - no TLS certificate support
-	url := fmt.Sprintf("http://%s/?host=%s&port=%d&path=", httpHost, vncHost, sock.GetPort())
-	if cCtx.Bool("no-pretty") {
+	url := fmt.Sprintf("http://%s/?host=%s&port=%s&path=", httpHost, vncHost, vncPort)
+	if !IsPrettyOutput(cCtx) {
 		fmt.Println(url)
 	} else {
 		PrintSuccess("A VNC viewer is running: %s\n", url)
@@ -405,7 +539,7 @@ func VNC(cCtx *cli.Context) error {
 		return err
 	}
 
-	if !cCtx.Bool("no-pretty") {
+	if IsPrettyOutput(cCtx) {
 		color.Yellow("Press 'Enter' to stop the HTTP server.")
 	}
 	bufio.NewReader(os.Stdin).ReadBytes('\n')
@@ -420,67 +554,134 @@ func VNC(cCtx *cli.Context) error {
 
 // Power is a handler for the "vm power" command.
 func Power(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	action, ok := v1.PowerAction_value[strings.ToUpper(cCtx.String("action"))]
-	if !ok {
-		return UnknownPowerAction
+	action, err := parsePowerAction(cCtx.String("action"))
+	if err != nil {
+		return err
 	}
 
-	id, err := uuid.Parse(cCtx.String("id"))
+	w, err := newPowerWait(cCtx)
 	if err != nil {
 		return err
 	}
 
-	res, err := client.VmRegistry.SendPowerAction(
-		cCtx.Context,
-		&v1.SendPowerActionRequest{
-			Machine: &v1.UUID{
-				Value: id.String(),
-			},
-			Action: v1.PowerAction(action),
-		},
-	)
-
+	ids, err := newVmResolver(cCtx, client).Targets(cCtx)
 	if err != nil {
 		return err
 	}
-	if res.GetError() != nil {
-		return formatError(res.GetError())
+
+	if verb, ok := destructivePowerActions[action]; ok {
+		if err := checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, verb, ids...); err != nil {
+			return err
+		}
+		if err := confirm(cCtx, client, &confirmation{verb: verb, kind: KindVirtualMachine, ids: ids}); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return forEachTarget(ids, func(id *v1.UUID) error {
+		if err := sendPowerAction(cCtx.Context, client, id, action); err != nil || !cCtx.Bool("wait") {
+			return err
+		}
+		return w.until(cCtx.Context, client, id, powerActionState(action), w.timeout)
+	})
+}
+
+// destructivePowerActions are the power actions which need confirmation, mapped to their verbs in prompts.
+// An ACPI shutdown isn't one of them, as the guest shuts itself down cleanly.
+var destructivePowerActions = map[v1.PowerAction]string{
+	v1.PowerAction_POWERDOWN: "power off",
+	v1.PowerAction_RESET:     "reset",
+}
+
+// parsePowerAction parses a case-insensitive power action name, "poweroff" is accepted as an alias of "powerdown".
+func parsePowerAction(name string) (v1.PowerAction, error) {
+	name = strings.ToUpper(name)
+	if name == "POWEROFF" {
+		return v1.PowerAction_POWERDOWN, nil
+	}
+
+	action, ok := v1.PowerAction_value[name]
+	if !ok {
+		return 0, UnknownPowerAction
+	}
+	return v1.PowerAction(action), nil
 }
 
 // GetVmMetadata is a handler for the "vm metadata" command.
 func GetVmMetadata(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	return GetMetadataFunc(client.VmRegistry)(cCtx)
+	return GetMetadataFunc(client.VmRegistry, newVmResolver(cCtx, client))(cCtx)
 }
 
 // SetVmMetadata is a handler for the "vm metadata set" command.
 func SetVmMetadata(cCtx *cli.Context) error {
-	client, err := libkitsune.NewOrCachedKitsuneClient(cCtx.String("target"), cCtx.Bool("ssl"))
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	return SetMetadataFunc(client.VmRegistry, newVmResolver(cCtx, client))(cCtx)
+}
+
+// PatchVmMetadata is a handler for the "vm metadata patch" command.
+func PatchVmMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
 	if err != nil {
 		return err
 	}
 
-	return SetMetadataFunc(client.VmRegistry)(cCtx)
+	return PatchMetadataFunc(client.VmRegistry, newVmResolver(cCtx, client))(cCtx)
+}
+
+// EditVmMetadata is a handler for the "vm metadata edit" command.
+func EditVmMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	return EditMetadataFunc(client.VmRegistry, newVmResolver(cCtx, client))(cCtx)
 }
 
 // ClearVmMetadata is a handler for the "vm metadata clear" command.
 func ClearVmMetadata(cCtx *cli.Context) error {
+	client, err := newClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ids, err := newVmResolver(cCtx, client).Targets(cCtx)
+	if err != nil {
+		return err
+	}
+	if err := checkProtected(cCtx.Context, client.VmRegistry, KindVirtualMachine, "clear the metadata of", ids...); err != nil {
+		return err
+	}
+	if err := confirm(cCtx, client, &confirmation{verb: "clear the metadata of", kind: KindVirtualMachine, ids: ids}); err != nil {
+		return err
+	}
+
 	if err := cCtx.Set("data", "{}"); err != nil {
 		return err
 	}
-	return SetImageMetadata(cCtx)
+	return SetVmMetadata(cCtx)
+}
+
+// formatStatus formats the supplied virtual machine liveness to a readable status.
+func formatStatus(alive bool) string {
+	if alive {
+		return "Running"
+	}
+	return "Stopped"
 }
 
 // serveVNC starts an HTTP server serving a small noVNC application.
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"github.com/lusory/libkitsune/proto/kitsune/proto/v1"
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"512K", 512 << 10, false},
+		{"512m", 512 << 20, false},
+		{"20G", 20 << 30, false},
+		{"2T", 2 << 40, false},
+		{"18446744073709551615", 1<<64 - 1, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"1.5G", 0, true},
+		{"-1", 0, true},
+		{"10GB", 0, true},
+		{"10KM", 0, true},
+		{"16777216T", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.size, func(t *testing.T) {
+			got, err := parseSize(test.size)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseSize() = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSize() failed: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("parseSize() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDisk(t *testing.T) {
+	tests := []struct {
+		spec    string
+		format  v1.Image_Format
+		size    uint64
+		data    map[string]string
+		wantErr bool
+	}{
+		{"qcow2:20G", v1.Image_QCOW2, 20 << 30, map[string]string{}, false},
+		{"RAW:1024", v1.Image_RAW, 1024, map[string]string{}, false},
+		{"qcow2:1M:name=root:role=", v1.Image_QCOW2, 1 << 20, map[string]string{"name": "root", "role": ""}, false},
+		{"qcow2", 0, 0, nil, true},
+		{"vhd:1G", 0, 0, nil, true},
+		{"qcow2:0", 0, 0, nil, true},
+		{"qcow2:big", 0, 0, nil, true},
+		{"qcow2:1G:name", 0, 0, nil, true},
+		{"qcow2:1G:=root", 0, 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			disk, err := parseDisk(test.spec)
+			if test.wantErr {
+				if !errors.Is(err, InvalidDisk) {
+					t.Errorf("parseDisk() error = %v, want %v", err, InvalidDisk)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDisk() failed: %v", err)
+			}
+			if disk.format != test.format || disk.size != test.size || !reflect.DeepEqual(disk.data, test.data) {
+				t.Errorf("parseDisk() = %s, %d, %v, want %s, %d, %v", disk.format, disk.size, disk.data, test.format, test.size, test.data)
+			}
+		})
+	}
+}